@@ -33,7 +33,7 @@ import (
         "math"
         "net"
         "os"
-        "strconv"
+        "sort"
 
         "gopkg.in/dnaeon/go-traceroute.v1/tracer"
 )
@@ -91,7 +91,7 @@ func main() {
                         writeHop(os.Stdout, prevNode)
                         for _, currNode := range currNodes {
                                 writeHop(os.Stdout, currNode)
-                                fmt.Fprintf(os.Stdout, "\t%d -> %d\n", dotId(prevNode), dotId(currNode))
+                                fmt.Fprintf(os.Stdout, "\t%s -> %s\n", nodeId(prevNode), nodeId(currNode))
                         }
                 }
         }
@@ -104,18 +104,12 @@ func writeHop(w io.Writer, p *tracer.Probe) {
         if p.Hop.Equal(net.IPv4zero) {
                 label = "*"
         }
-        fmt.Fprintf(w, "\t%d [label=\"%s\"]\n", dotId(p), label)
+        fmt.Fprintf(w, "\t%s [label=\"%s\"]\n", nodeId(p), label)
 }
 
-// Returns the unique dot ID for the given probe
-func dotId(p *tracer.Probe) int64 {
-        addr := fmt.Sprintf("%p", p)
-        id, err := strconv.ParseInt(addr[2:], 16, 64)
-        if err != nil {
-                panic(err)
-        }
-
-        return id
+// Returns the dot ID for the hop of the given probe
+func nodeId(p *tracer.Probe) string {
+        return tracer.HopNodeID(p.Hop, p.TTL)
 }
 
 // Returns the list of unique hops based on the hop
@@ -133,5 +127,10 @@ func uniqueHops(probes []*tracer.Probe) []*tracer.Probe {
                 result = append(result, v)
         }
 
+        // Keep the output reproducible across runs
+        sort.Slice(result, func(i, j int) bool {
+                return result[i].Hop.String() < result[j].Hop.String()
+        })
+
         return result
 }
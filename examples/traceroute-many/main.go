@@ -0,0 +1,107 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+        "bufio"
+        "context"
+        "fmt"
+        "log"
+        "net"
+        "os"
+        "strings"
+
+        "gopkg.in/dnaeon/go-traceroute.v1/tracer"
+)
+
+// Maximum number of destinations to trace at the same time
+const concurrency = 4
+
+func main() {
+        if len(os.Args) != 2 {
+                fmt.Fprintf(os.Stderr, "Usage: traceroute-many <file>\n")
+                os.Exit(64)
+        }
+
+        hosts, err := readHosts(os.Args[1])
+        if err != nil {
+                log.Fatal(err)
+        }
+
+        // A mapping between destination IP and the host it was resolved from
+        names := make(map[string]string)
+        dests := make([]net.IP, 0, len(hosts))
+        for _, host := range hosts {
+                dest, err := net.ResolveIPAddr("ip", host)
+                if err != nil {
+                        log.Fatal(err)
+                }
+                names[dest.IP.String()] = host
+                dests = append(dests, dest.IP)
+        }
+
+        ctx := context.Background()
+        opts := tracer.DefaultOptions
+        t := tracer.New(opts)
+        ch := t.TraceMany(ctx, dests, concurrency)
+
+        for probe := range ch {
+                host := names[probe.Destination.String()]
+                if probe.Error != nil {
+                        fmt.Printf("%-30s %-3d %s\n", host, probe.TTL, probe.Error)
+                        continue
+                }
+
+                hop := "*"
+                if !probe.Hop.Equal(net.IPv4zero) {
+                        hop = probe.Hop.String()
+                }
+                diff := probe.End.Sub(probe.Start).String()
+                fmt.Printf("%-30s %-3d %-15s %s\n", host, probe.TTL, hop, diff)
+        }
+}
+
+// Reads the list of hosts from the given file. Empty lines and lines
+// starting with '#' are ignored.
+func readHosts(path string) ([]string, error) {
+        f, err := os.Open(path)
+        if err != nil {
+                return nil, err
+        }
+        defer f.Close()
+
+        hosts := make([]string, 0)
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+                line := strings.TrimSpace(scanner.Text())
+                if line == "" || strings.HasPrefix(line, "#") {
+                        continue
+                }
+                hosts = append(hosts, line)
+        }
+
+        return hosts, scanner.Err()
+}
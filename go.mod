@@ -2,6 +2,7 @@ module gopkg.in/dnaeon/go-traceroute.v1
 
 go 1.20
 
-require golang.org/x/net v0.9.0
-
-require golang.org/x/sys v0.7.0 // indirect
+require (
+	golang.org/x/net v0.9.0
+	golang.org/x/sys v0.7.0
+)
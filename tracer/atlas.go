@@ -0,0 +1,113 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "encoding/json"
+        "math"
+)
+
+// Represents a single reply of a hop in the RIPE Atlas format
+type atlasReply struct {
+        From  string   `json:"from,omitempty"`
+        RTT   *float64 `json:"rtt,omitempty"`
+        Size  int      `json:"size,omitempty"`
+        TTL   int      `json:"ttl,omitempty"`
+        X     string   `json:"x,omitempty"`
+        Error string   `json:"error,omitempty"`
+}
+
+// Represents a single hop in the RIPE Atlas format
+type atlasHop struct {
+        Hop    int          `json:"hop"`
+        Result []atlasReply `json:"result"`
+}
+
+// Represents a traceroute measurement in the RIPE Atlas format
+type atlasResult struct {
+        AF        int        `json:"af"`
+        DstAddr   string     `json:"dst_addr"`
+        DstName   string     `json:"dst_name"`
+        Proto     string     `json:"proto"`
+        Type      string     `json:"type"`
+        Timestamp int64      `json:"timestamp"`
+        EndTime   int64      `json:"endtime"`
+        Result    []atlasHop `json:"result"`
+}
+
+// MarshalAtlasJSON encodes the result in the traceroute result format
+// of RIPE Atlas, which is also understood by the tools and dashboards
+// built around it.
+//
+// The output follows the current traceroute result format documented
+// by RIPE Atlas, and earlier firmware versions are not emulated. Fields
+// describing the measurement infrastructure (prb_id, msm_id, fw,
+// from, src_addr) are not known to the tracer and are omitted, so
+// consumers which pick the format by fw should assume the latest.
+//
+// The size and TTL of a reply are taken from the ReplyBytes and
+// ReplyTTL of its probe, and omitted if the platform did not report
+// them. A probe which did not receive a reply is represented as
+// {"x": "*"}, and a probe which failed is represented as
+// {"error": "..."}. RTTs are in milliseconds.
+func (r *Result) MarshalAtlasJSON() ([]byte, error) {
+        out := atlasResult{
+                AF:        4,
+                DstAddr:   r.Destination.String(),
+                DstName:   r.Destination.String(),
+                Proto:     "UDP",
+                Type:      "traceroute",
+                Timestamp: r.Start.Unix(),
+                EndTime:   r.End.Unix(),
+                Result:    make([]atlasHop, 0, len(r.Hops)),
+        }
+
+        for _, hop := range r.Hops {
+                h := atlasHop{
+                        Hop:    hop.TTL,
+                        Result: make([]atlasReply, 0, len(hop.Probes)),
+                }
+                for _, p := range hop.Probes {
+                        var reply atlasReply
+                        switch {
+                        case p.Error != nil:
+                                reply.Error = p.Error.Error()
+                        case !p.Responded():
+                                reply.X = "*"
+                        default:
+                                rtt := math.Round(float64(p.RTT().Microseconds())) / 1000
+                                reply.From = p.Hop.String()
+                                reply.RTT = &rtt
+                                reply.Size = p.ReplyBytes
+                                reply.TTL = p.ReplyTTL
+                        }
+                        h.Result = append(h.Result, reply)
+                }
+                out.Result = append(out.Result, h)
+        }
+
+        return json.Marshal(out)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "bytes"
+        "encoding/json"
+        "errors"
+        "flag"
+        "net"
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestMarshalAtlasJSON(t *testing.T) {
+        start := time.Unix(1700000000, 0)
+        probe := func(ttl int, hop net.IP, rtt time.Duration, replyTTL, replyBytes int) Probe {
+                return Probe{
+                        TTL:        ttl,
+                        Hop:        hop,
+                        Start:      start,
+                        End:        start.Add(rtt),
+                        ReplyTTL:   replyTTL,
+                        ReplyBytes: replyBytes,
+                }
+        }
+        dest := net.IPv4(198, 51, 100, 1)
+        result := &Result{
+                Destination: dest,
+                Start:       start,
+                End:         start.Add(3 * time.Second),
+                Hops: []Hop{
+                        {TTL: 1, Probes: []Probe{
+                                probe(1, net.IPv4(192, 0, 2, 1), 1234*time.Microsecond, 64, 28),
+                                probe(1, net.IPv4(192, 0, 2, 1), 987*time.Microsecond, 64, 28),
+                        }},
+                        {TTL: 2, Probes: []Probe{
+                                probe(2, net.IPv4zero, 0, 0, 0),
+                                {TTL: 2, Error: errors.New("unable to send probe with TTL 2")},
+                        }},
+                        {TTL: 3, Probes: []Probe{
+                                probe(3, dest, 12500*time.Microsecond, 0, 0),
+                        }},
+                },
+        }
+
+        b, err := result.MarshalAtlasJSON()
+        if err != nil {
+                t.Fatalf("MarshalAtlasJSON: %v", err)
+        }
+        var got bytes.Buffer
+        if err := json.Indent(&got, b, "", "  "); err != nil {
+                t.Fatalf("invalid JSON: %v", err)
+        }
+        got.WriteByte('\n')
+
+        golden := filepath.Join("testdata", "atlas.json")
+        if *update {
+                if err := os.WriteFile(golden, got.Bytes(), 0644); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        want, err := os.ReadFile(golden)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !bytes.Equal(got.Bytes(), want) {
+                t.Errorf("got\n%s\nwant\n%s", got.Bytes(), want)
+        }
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "errors"
+        "net"
+        "time"
+)
+
+// ErrNotEnoughSamples is returned by EstimateBottleneck, if the
+// destination did not respond to enough of the probe sizes.
+var ErrNotEnoughSamples = errors.New("not enough samples for an estimate")
+
+// Payload sizes of the probes sent by EstimateBottleneck, which stay
+// below the common MTU of 1500 bytes
+var bottleneckProbeSizes = []int{32, 256, 512, 768, 1024, 1280, 1400}
+
+// BandwidthEstimate is the result of EstimateBottleneck.
+type BandwidthEstimate struct {
+        // Sizes are the payload sizes, which got a response from the
+        // destination
+        Sizes []int
+
+        // MinRTTs are the minimum RTTs observed for each of Sizes
+        MinRTTs []time.Duration
+
+        // PerByte is the increase of the RTT per byte of payload, i.e.
+        // the serialization delay of the slowest link
+        PerByte time.Duration
+
+        // BaseRTT is the RTT of an empty payload, as extrapolated from
+        // the samples
+        BaseRTT time.Duration
+
+        // Capacity is the estimated capacity of the bottleneck link in
+        // bits per second, or zero if the RTT did not grow with the
+        // payload size
+        Capacity float64
+}
+
+// EstimateBottleneck sends probes of increasing payload sizes to the
+// destination, and estimates the capacity of the bottleneck link from
+// the growth of the minimum RTT with the size. The estimate is
+// best-effort and experimental, as it is easily skewed by cross
+// traffic, ICMP rate limiting and the size of the replies. The payload
+// size is controlled by the estimate, so Options.PacketLength and
+// Options.Encoder are ignored.
+func (t *Tracer) EstimateBottleneck(ctx context.Context, dest net.IP) (BandwidthEstimate, error) {
+        sizes := make([]int, 0, len(bottleneckProbeSizes))
+        minRTTs := make([]time.Duration, 0, len(bottleneckProbeSizes))
+        for _, size := range bottleneckProbeSizes {
+                minRTT, ok, err := t.minRTTWithSize(ctx, dest, size)
+                if err != nil {
+                        return BandwidthEstimate{Sizes: sizes, MinRTTs: minRTTs}, err
+                }
+                if !ok {
+                        continue
+                }
+                sizes = append(sizes, size)
+                minRTTs = append(minRTTs, minRTT)
+        }
+
+        return fitBottleneck(sizes, minRTTs)
+}
+
+// Estimates the bottleneck from the minimum RTTs of the payload sizes
+// by a least squares fit of the RTT over the size. At least two
+// distinct sizes are required.
+func fitBottleneck(sizes []int, minRTTs []time.Duration) (BandwidthEstimate, error) {
+        estimate := BandwidthEstimate{
+                Sizes:   sizes,
+                MinRTTs: minRTTs,
+        }
+
+        var sumX, sumY, sumXY, sumXX float64
+        n := float64(len(sizes))
+        for i, size := range sizes {
+                x := float64(size)
+                y := float64(minRTTs[i])
+                sumX += x
+                sumY += y
+                sumXY += x * y
+                sumXX += x * x
+        }
+        denom := n*sumXX - sumX*sumX
+        if len(sizes) < 2 || denom == 0 {
+                return estimate, ErrNotEnoughSamples
+        }
+        slope := (n*sumXY - sumX*sumY) / denom
+        intercept := (sumY - slope*sumX) / n
+
+        estimate.BaseRTT = time.Duration(intercept)
+        if slope > 0 {
+                estimate.PerByte = time.Duration(slope)
+                estimate.Capacity = 8 / (slope / float64(time.Second))
+        }
+
+        return estimate, nil
+}
+
+// Probes the destination with payloads of the given size and returns
+// the minimum RTT of the probes, which reached it.
+func (t *Tracer) minRTTWithSize(ctx context.Context, dest net.IP, size int) (time.Duration, bool, error) {
+        sized := t.clone(func(opts *Options) {
+                opts.PacketLength = size
+                opts.Encoder = nil
+                opts.EmitFirstResponse = false
+                opts.ResolveNames = false
+                opts.OnHopDiscovered = nil
+                opts.AdaptiveProbes = false
+                opts.SuppressStars = false
+                opts.FailFast = false
+                opts.FailFastOnFirstHop = false
+                opts.DetectLoops = false
+                opts.MaxAcceptableRTT = 0
+                opts.MinPlausibleRTT = 0
+        })
+
+        var minRTT time.Duration
+        ok := false
+        for probe := range sized.TraceTTLs(ctx, dest, []int{sized.opts.MaxHops}) {
+                if probe.Error != nil {
+                        return 0, false, probe.Error
+                }
+                if !probe.Reached {
+                        continue
+                }
+                if !ok || probe.RTT() < minRTT {
+                        minRTT = probe.RTT()
+                        ok = true
+                }
+        }
+
+        return minRTT, ok, ctx.Err()
+}
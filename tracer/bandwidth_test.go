@@ -0,0 +1,114 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "errors"
+        "math"
+        "net"
+        "testing"
+        "time"
+)
+
+func TestFitBottleneck(t *testing.T) {
+        us := time.Microsecond
+        tests := []struct {
+                name     string
+                sizes    []int
+                rtts     []time.Duration
+                err      error
+                perByte  time.Duration
+                baseRTT  time.Duration
+                capacity float64
+        }{
+                {"linear", []int{100, 200, 300}, []time.Duration{1800, 2600, 3400}, nil, 8, 1000, 1e9},
+                {"noisy", []int{100, 200, 300, 400}, []time.Duration{1800, 2700, 3300, 4200}, nil, 7, 1050, 8e9 / 7.8},
+                {"flat", []int{100, 200, 300}, []time.Duration{us, us, us}, nil, 0, us, 0},
+                {"negative slope", []int{100, 200, 300}, []time.Duration{3400, 2600, 1800}, nil, 0, 4200, 0},
+                {"single size", []int{100}, []time.Duration{us}, ErrNotEnoughSamples, 0, 0, 0},
+                {"repeated size", []int{100, 100}, []time.Duration{us, 2 * us}, ErrNotEnoughSamples, 0, 0, 0},
+                {"no samples", nil, nil, ErrNotEnoughSamples, 0, 0, 0},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        estimate, err := fitBottleneck(tc.sizes, tc.rtts)
+                        if !errors.Is(err, tc.err) {
+                                t.Fatalf("got error %v, want %v", err, tc.err)
+                        }
+                        if len(estimate.Sizes) != len(tc.sizes) || len(estimate.MinRTTs) != len(tc.rtts) {
+                                t.Errorf("got %d sizes and %d RTTs, want %d", len(estimate.Sizes), len(estimate.MinRTTs), len(tc.sizes))
+                        }
+                        if estimate.PerByte != tc.perByte {
+                                t.Errorf("got %v per byte, want %v", estimate.PerByte, tc.perByte)
+                        }
+                        if d := estimate.BaseRTT - tc.baseRTT; d < -1 || d > 1 {
+                                t.Errorf("got a base RTT of %v, want %v", estimate.BaseRTT, tc.baseRTT)
+                        }
+                        if math.Abs(estimate.Capacity-tc.capacity) > tc.capacity*1e-9 {
+                                t.Errorf("got a capacity of %v bit/s, want %v bit/s", estimate.Capacity, tc.capacity)
+                        }
+                })
+        }
+}
+
+func TestEstimateBottleneckError(t *testing.T) {
+        opts := &Options{
+                DestinationPort:      33434,
+                MaxHops:              1,
+                NumProbes:            1,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        }
+        cancelled, cancel := context.WithCancel(context.Background())
+        cancel()
+        shutdown := New(opts)
+        if err := shutdown.Shutdown(context.Background()); err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                name   string
+                tracer *Tracer
+                ctx    context.Context
+                err    error
+        }{
+                {"cancelled", New(opts), cancelled, context.Canceled},
+                {"shut down", shutdown, context.Background(), ErrShutdown},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        estimate, err := tc.tracer.EstimateBottleneck(tc.ctx, net.IPv4(127, 0, 0, 1))
+                        if !errors.Is(err, tc.err) {
+                                t.Errorf("got error %v, want %v", err, tc.err)
+                        }
+                        if len(estimate.Sizes) != 0 || estimate.Capacity != 0 {
+                                t.Errorf("got estimate %+v, want none", estimate)
+                        }
+                })
+        }
+}
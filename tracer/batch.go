@@ -0,0 +1,127 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "net"
+        "sync"
+        "sync/atomic"
+)
+
+// BatchProbe represents a trace probe, which is tagged with the
+// destination it belongs to.
+type BatchProbe struct {
+        // Destination being traced
+        Destination net.IP
+
+        Probe
+}
+
+// TraceMany traces the hops between us and each of the given
+// destinations, running at most concurrency traces at a time. A
+// concurrency of less than one traces the destinations one after
+// another.
+//
+// The probes of a single destination are delivered in the same order
+// as Trace delivers them, while probes of different destinations may
+// be interleaved with each other.
+func (t *Tracer) TraceMany(ctx context.Context, dests []net.IP, concurrency int) <-chan BatchProbe {
+        ch, _ := t.TraceManyWithCancel(ctx, dests, concurrency)
+        return ch
+}
+
+// TraceManyWithCancel works like TraceMany, but also returns a cancel
+// function for each destination, which stops the trace of dests[i]
+// without affecting the rest of the batch. A destination cancelled
+// this way emits a final probe with context.Canceled as its error,
+// unless its trace had already completed.
+func (t *Tracer) TraceManyWithCancel(ctx context.Context, dests []net.IP, concurrency int) (<-chan BatchProbe, []context.CancelFunc) {
+        ch := make(chan BatchProbe)
+        if concurrency < 1 {
+                concurrency = 1
+        }
+
+        // Shutdown stops the dispatching of the destinations. Once the
+        // Tracer has been shut down, the trace of each destination
+        // fails with ErrShutdown instead.
+        untrack := func() {}
+        if tracked, done, err := t.track(ctx); err == nil {
+                ctx, untrack = tracked, done
+        }
+
+        contexts := make([]context.Context, len(dests))
+        cancels := make([]context.CancelFunc, len(dests))
+        for i := range dests {
+                contexts[i], cancels[i] = context.WithCancel(ctx)
+        }
+
+        worker := func(wg *sync.WaitGroup, sem <-chan struct{}, i int) {
+                defer wg.Done()
+                defer func() { <-sem }()
+                defer cancels[i]()
+
+                dest := dests[i]
+                destCtx := contexts[i]
+                var interrupted atomic.Bool
+                if destCtx.Err() == nil {
+                        for probe := range t.tracePath(destCtx, dest, &interrupted) {
+                                ch <- BatchProbe{Destination: dest, Probe: probe}
+                        }
+                } else {
+                        interrupted.Store(true)
+                }
+
+                // Only this destination has been cancelled, before its
+                // trace completed
+                if interrupted.Load() && ctx.Err() == nil {
+                        ch <- BatchProbe{Destination: dest, Probe: Probe{Error: context.Canceled}}
+                }
+        }
+
+        dispatcher := func() {
+                defer untrack()
+
+                var wg sync.WaitGroup
+                sem := make(chan struct{}, concurrency)
+        L:
+                for i := range dests {
+                        select {
+                        case <-ctx.Done():
+                                break L
+                        case sem <- struct{}{}:
+                        }
+
+                        wg.Add(1)
+                        go worker(&wg, sem, i)
+                }
+                wg.Wait()
+                close(ch)
+        }
+
+        go dispatcher()
+        return ch, cancels
+}
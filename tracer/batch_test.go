@@ -0,0 +1,72 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "errors"
+        "net"
+        "testing"
+        "time"
+)
+
+func TestTraceManyWithCancel(t *testing.T) {
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              2,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        })
+        done, cancelled := net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)
+        ch, cancels := tracer.TraceManyWithCancel(context.Background(), []net.IP{done, cancelled}, 1)
+
+        // The second destination is cancelled before its trace starts,
+        // while the first one is cancelled after its last probe
+        cancels[1]()
+        probes := make(map[string]int)
+        markers := make(map[string]int)
+        for probe := range ch {
+                key := probe.Destination.String()
+                if errors.Is(probe.Error, context.Canceled) {
+                        markers[key]++
+                        continue
+                }
+                if probe.Error != nil {
+                        t.Fatal(probe.Error)
+                }
+                probes[key]++
+                if probe.Destination.Equal(done) && probes[key] == 3 {
+                        cancels[0]()
+                }
+        }
+
+        if probes[done.String()] != 3 || markers[done.String()] != 0 {
+                t.Errorf("got %d probes and %d cancellations of the completed trace, want 3 and none", probes[done.String()], markers[done.String()])
+        }
+        if probes[cancelled.String()] != 0 || markers[cancelled.String()] != 1 {
+                t.Errorf("got %d probes and %d cancellations of the cancelled trace, want none and 1", probes[cancelled.String()], markers[cancelled.String()])
+        }
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// Interval at which the cached time of Options.CoarseTiming is updated
+const coarseClockInterval = time.Millisecond
+
+// Coarse clock shared by all tracers with Options.CoarseTiming set
+var coarse coarseClock
+
+// Clock caching the current time, which is updated by a background
+// ticker. The ticker only runs while at least one trace uses the clock.
+type coarseClock struct {
+        mu    sync.Mutex
+        users int
+        stop  chan struct{}
+        now   atomic.Pointer[time.Time]
+}
+
+// Registers a user of the clock, and starts the ticker for the first
+// one.
+func (c *coarseClock) acquire() {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        c.users++
+        if c.users > 1 {
+                return
+        }
+
+        now := time.Now()
+        c.now.Store(&now)
+        c.stop = make(chan struct{})
+        go c.run(c.stop)
+}
+
+// Unregisters a user of the clock, and stops the ticker after the last
+// one.
+func (c *coarseClock) release() {
+        c.mu.Lock()
+        defer c.mu.Unlock()
+
+        c.users--
+        if c.users == 0 {
+                close(c.stop)
+                c.stop = nil
+        }
+}
+
+// Updates the cached time on every tick, until stop is closed.
+func (c *coarseClock) run(stop <-chan struct{}) {
+        ticker := time.NewTicker(coarseClockInterval)
+        defer ticker.Stop()
+
+        for {
+                select {
+                case <-stop:
+                        return
+                case now := <-ticker.C:
+                        c.now.Store(&now)
+                }
+        }
+}
+
+// Returns the cached time.
+func (c *coarseClock) load() time.Time {
+        return *c.now.Load()
+}
+
+// Returns the current time for timestamping the probes of a trace,
+// which is the cached time of the coarse clock, if
+// Options.CoarseTiming is set.
+func (t *Tracer) now() time.Time {
+        if t.opts.CoarseTiming {
+                return coarse.load()
+        }
+
+        return time.Now()
+}
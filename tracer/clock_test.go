@@ -0,0 +1,107 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "net"
+        "testing"
+        "time"
+)
+
+func TestCoarseClock(t *testing.T) {
+        var c coarseClock
+
+        // Returns whether the cached time advances within a while
+        advances := func() bool {
+                before := c.load()
+                time.Sleep(20 * coarseClockInterval)
+                return c.load().After(before)
+        }
+
+        c.acquire()
+        c.acquire()
+        if c.load().IsZero() {
+                t.Fatal("got no time after acquire")
+        }
+        if !advances() {
+                t.Error("clock does not advance with two users")
+        }
+
+        c.release()
+        if !advances() {
+                t.Error("clock does not advance with one user left")
+        }
+
+        c.release()
+        time.Sleep(5 * coarseClockInterval)
+        if advances() {
+                t.Error("clock advances without users")
+        }
+
+        // The clock restarts with the next user
+        c.acquire()
+        defer c.release()
+        if time.Since(c.load()) > time.Second {
+                t.Errorf("got stale time %v after restart", c.load())
+        }
+        if !advances() {
+                t.Error("clock does not advance after restart")
+        }
+}
+
+func TestCoarseTiming(t *testing.T) {
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              2,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                CoarseTiming:         true,
+        })
+        begin := time.Now()
+        probes := 0
+        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                probes++
+                if probe.Error != nil {
+                        t.Fatal(probe.Error)
+                }
+
+                // The cached time lags behind by up to a tick
+                if probe.Start.Before(begin.Add(-2*coarseClockInterval)) || probe.End.Before(probe.Start) {
+                        t.Errorf("got probe from %v to %v, want after %v", probe.Start, probe.End, begin)
+                }
+        }
+        if probes != 3 {
+                t.Errorf("got %d probes, want 3", probes)
+        }
+
+        coarse.mu.Lock()
+        users := coarse.users
+        coarse.mu.Unlock()
+        if users != 0 {
+                t.Errorf("got %d users of the coarse clock after the trace, want 0", users)
+        }
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "errors"
+        "math"
+        "net"
+        "sort"
+)
+
+// HopChange represents a difference between the hops with the same
+// TTL of two traces.
+type HopChange struct {
+        // TTL of the changed hop
+        TTL int
+
+        // Hop from the previous trace, or nil if the previous trace did
+        // not reach this TTL
+        Old *Hop
+
+        // Hop from the current trace, or nil if the current trace did
+        // not reach this TTL
+        New *Hop
+
+        // AddrChanged is true, if the set of addresses which responded
+        // to the hop has changed
+        AddrChanged bool
+
+        // LossChanged is true, if the loss of the hop has changed by
+        // more than Options.LossChangeThreshold
+        LossChanged bool
+
+        // RTTChanged is true, if the average RTT of the hop has
+        // changed by more than both Options.RTTChangeAbsolute and
+        // Options.RTTChangeRelative
+        RTTChanged bool
+}
+
+// PathDiff compares the paths of two traces and returns the hops
+// whose set of responding addresses has changed, ordered by TTL. Hops
+// balanced over the same addresses are not reported, even if another
+// address responded first.
+func PathDiff(prev, curr *Result) []HopChange {
+        oldHops := hopsByTTL(prev)
+        newHops := hopsByTTL(curr)
+
+        changes := make([]HopChange, 0)
+        for ttl, oldHop := range oldHops {
+                newHop, ok := newHops[ttl]
+                if !ok || !sameAddrs(*oldHop, *newHop) {
+                        changes = append(changes, HopChange{TTL: ttl, Old: oldHop, New: newHop, AddrChanged: true})
+                }
+        }
+        for ttl, newHop := range newHops {
+                if _, ok := oldHops[ttl]; !ok {
+                        changes = append(changes, HopChange{TTL: ttl, New: newHop, AddrChanged: true})
+                }
+        }
+
+        sort.Slice(changes, func(i, j int) bool {
+                return changes[i].TTL < changes[j].TTL
+        })
+
+        return changes
+}
+
+// Returns a mapping between TTL and hop of the given result
+func hopsByTTL(r *Result) map[int]*Hop {
+        hops := make(map[int]*Hop)
+        if r == nil {
+                return hops
+        }
+        for i := range r.Hops {
+                hops[r.Hops[i].TTL] = &r.Hops[i]
+        }
+
+        return hops
+}
+
+// TraceDiff traces the hops between us and the destination and
+// reports only the hops which differ from the given baseline trace.
+// Besides address changes, a hop is reported when its loss or average
+// RTT differ from the baseline by more than the thresholds configured
+// in the Options. Hops of the baseline which are beyond the end of the
+// new trace are reported once the trace completes.
+func (t *Tracer) TraceDiff(ctx context.Context, dest net.IP, baseline *Result) (<-chan HopChange, error) {
+        if baseline == nil {
+                return nil, errors.New("no baseline trace provided")
+        }
+        if !baseline.Destination.Equal(dest) {
+                return nil, errors.New("baseline trace is for a different destination")
+        }
+
+        // The statistics of the hops need the probes without a
+        // response, and all of the probes of a hop
+        tracer := t.clone(func(opts *Options) {
+                opts.SuppressStars = false
+                opts.EmitFirstResponse = false
+        })
+
+        return t.diffProbes(ctx, tracer.Trace(ctx, dest), baseline), nil
+}
+
+// Groups the probes of a trace by TTL, and streams the hops which
+// differ from the baseline trace. The hops have to be probed one after
+// another, so that a hop is complete once a probe with another TTL
+// arrives.
+func (t *Tracer) diffProbes(ctx context.Context, probes <-chan Probe, baseline *Result) <-chan HopChange {
+        ch := make(chan HopChange)
+        oldHops := hopsByTTL(baseline)
+
+        differ := func() {
+                seen := make(map[int]bool)
+                pending := make(map[int][]Probe)
+                flush := func(except int) {
+                        ttls := make([]int, 0, len(pending))
+                        for ttl := range pending {
+                                if ttl != except {
+                                        ttls = append(ttls, ttl)
+                                }
+                        }
+                        sort.Ints(ttls)
+                        for _, ttl := range ttls {
+                                hop := newHop(ttl, pending[ttl])
+                                delete(pending, ttl)
+                                seen[ttl] = true
+                                if change, ok := t.diffHop(oldHops[ttl], &hop); ok {
+                                        ch <- change
+                                }
+                        }
+                }
+
+                for probe := range probes {
+                        if probe.TTL == 0 {
+                                continue
+                        }
+                        flush(probe.TTL)
+                        pending[probe.TTL] = append(pending[probe.TTL], probe)
+                }
+                flush(0)
+
+                // Report the baseline hops, which the new trace did not reach
+                if ctx.Err() == nil {
+                        for _, hop := range baseline.Hops {
+                                if !seen[hop.TTL] {
+                                        ch <- HopChange{TTL: hop.TTL, Old: oldHops[hop.TTL], AddrChanged: true}
+                                }
+                        }
+                }
+                close(ch)
+        }
+
+        go differ()
+        return ch
+}
+
+// Compares the new hop against the old one using the configured
+// thresholds, and returns the change, if any.
+func (t *Tracer) diffHop(oldHop, newHop *Hop) (HopChange, bool) {
+        change := HopChange{
+                TTL: newHop.TTL,
+                Old: oldHop,
+                New: newHop,
+        }
+        if oldHop == nil {
+                change.AddrChanged = true
+                return change, true
+        }
+
+        change.AddrChanged = !sameAddrs(*oldHop, *newHop)
+        change.LossChanged = math.Abs(newHop.Stats.Loss-oldHop.Stats.Loss) > t.opts.LossChangeThreshold
+        if oldHop.Stats.Received > 0 && newHop.Stats.Received > 0 {
+                delta := newHop.Stats.Avg - oldHop.Stats.Avg
+                if delta < 0 {
+                        delta = -delta
+                }
+                relative := float64(delta) / float64(oldHop.Stats.Avg) * 100
+                change.RTTChanged = delta > t.opts.RTTChangeAbsolute && relative > t.opts.RTTChangeRelative
+        }
+
+        return change, change.AddrChanged || change.LossChanged || change.RTTChanged
+}
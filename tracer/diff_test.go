@@ -0,0 +1,175 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "errors"
+        "net"
+        "testing"
+        "time"
+)
+
+func TestTraceDiffGroupsHops(t *testing.T) {
+        dest := net.IPv4(127, 0, 0, 1)
+        baseline := NewResult(dest, []Probe{
+                {TTL: 1, Hop: net.IPv4(192, 0, 2, 1)},
+        })
+
+        // Neither option may leak into the statistics of the hops
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              1,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                SuppressStars:        true,
+                EmitFirstResponse:    true,
+        })
+        ch, err := tracer.TraceDiff(context.Background(), dest, baseline)
+        if err != nil {
+                t.Fatalf("TraceDiff: %v", err)
+        }
+
+        changes := make([]HopChange, 0)
+        for change := range ch {
+                changes = append(changes, change)
+        }
+        if len(changes) != 1 {
+                t.Fatalf("got %d changes, want 1: %+v", len(changes), changes)
+        }
+        change := changes[0]
+        if change.TTL != 1 || !change.AddrChanged || change.New == nil {
+                t.Fatalf("got change %+v, want an address change at TTL 1", change)
+        }
+        if n := len(change.New.Probes); n != 3 {
+                t.Errorf("got %d probes of the hop, want 3", n)
+        }
+        if s := change.New.Stats; s.Sent != 3 {
+                t.Errorf("got %d probes sent to the hop, want 3", s.Sent)
+        }
+}
+
+func TestDiffProbes(t *testing.T) {
+        dest := net.IPv4(198, 51, 100, 1)
+        a := net.IPv4(192, 0, 2, 1)
+        b := net.IPv4(192, 0, 2, 2)
+        baseline := NewResult(dest, []Probe{
+                {TTL: 1, Hop: a},
+                {TTL: 1, Hop: a},
+                {TTL: 2, Hop: b},
+                {TTL: 2, Hop: b},
+                {TTL: 3, Hop: dest, Reached: true},
+        })
+
+        ch := make(chan Probe)
+        go func() {
+                for _, p := range []Probe{
+                        {TTL: 1, Hop: a},
+                        {TTL: 1, Hop: a},
+                        {TTL: 2, Hop: net.IPv4zero},
+                        {TTL: 2, Hop: net.IPv4zero},
+                        {Error: errors.New("trace failed")},
+                } {
+                        ch <- p
+                }
+                close(ch)
+        }()
+
+        tracer := New(&Options{LossChangeThreshold: 10})
+        changes := make([]HopChange, 0)
+        for change := range tracer.diffProbes(context.Background(), ch, baseline) {
+                changes = append(changes, change)
+        }
+
+        if len(changes) != 2 {
+                t.Fatalf("got %d changes, want 2: %+v", len(changes), changes)
+        }
+
+        // The dark hop was probed, so it is not reported as missing
+        dark := changes[0]
+        if dark.TTL != 2 || dark.New == nil || !dark.AddrChanged || !dark.LossChanged {
+                t.Errorf("got change %+v, want address and loss change at TTL 2", dark)
+        } else if dark.New.Stats.Loss != 100 {
+                t.Errorf("got %.0f%% loss at TTL 2, want 100%%", dark.New.Stats.Loss)
+        }
+
+        missing := changes[1]
+        if missing.TTL != 3 || missing.New != nil || !missing.AddrChanged {
+                t.Errorf("got change %+v, want the missing hop at TTL 3", missing)
+        }
+}
+
+func TestDiffHopThresholds(t *testing.T) {
+        ms := time.Millisecond
+        hop := func(avg time.Duration, loss float64) *Hop {
+                h := &Hop{TTL: 1, Addr: net.IPv4(192, 0, 2, 1), Stats: HopStats{Sent: 10, Loss: loss}}
+                if avg > 0 {
+                        h.Stats.Received = 10
+                        h.Stats.Avg = avg
+                }
+                return h
+        }
+        tracer := New(&Options{
+                LossChangeThreshold: 10,
+                RTTChangeAbsolute:   5 * ms,
+                RTTChangeRelative:   20,
+        })
+
+        tests := []struct {
+                name string
+                old  *Hop
+                new  *Hop
+                rtt  bool
+                loss bool
+        }{
+                {"absolute just under", hop(20*ms, 0), hop(24900*time.Microsecond, 0), false, false},
+                {"absolute just over", hop(20*ms, 0), hop(25100*time.Microsecond, 0), true, false},
+                {"relative just under", hop(100*ms, 0), hop(119900*time.Microsecond, 0), false, false},
+                {"relative just over", hop(100*ms, 0), hop(120100*time.Microsecond, 0), true, false},
+                {"both at the thresholds", hop(25*ms, 0), hop(30*ms, 0), false, false},
+                {"decrease just over", hop(20*ms, 0), hop(14900*time.Microsecond, 0), true, false},
+                {"no old responses", hop(0, 100), hop(20*ms, 0), false, true},
+                {"loss just under", hop(20*ms, 0), hop(20*ms, 9.9), false, false},
+                {"loss at the threshold", hop(20*ms, 0), hop(20*ms, 10), false, false},
+                {"loss just over", hop(20*ms, 0), hop(20*ms, 10.1), false, true},
+                {"loss decrease just over", hop(20*ms, 30), hop(20*ms, 19.9), false, true},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        change, changed := tracer.diffHop(tc.old, tc.new)
+                        if change.RTTChanged != tc.rtt || change.LossChanged != tc.loss {
+                                t.Errorf("got RTTChanged %v and LossChanged %v, want %v and %v", change.RTTChanged, change.LossChanged, tc.rtt, tc.loss)
+                        }
+                        if change.AddrChanged {
+                                t.Error("got AddrChanged for the same address")
+                        }
+                        if changed != (tc.rtt || tc.loss) {
+                                t.Errorf("got changed %v, want %v", changed, tc.rtt || tc.loss)
+                        }
+                })
+        }
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "bytes"
+)
+
+// ProbeEncoder constructs the payload of the outgoing probes and
+// recognizes the replies to them. A custom encoder may be configured
+// via Options.Encoder, in order to send payloads of a different
+// shape, e.g. ones which are expected by a specific middlebox.
+type ProbeEncoder interface {
+        // Encode returns the payload of the probe with the given TTL and
+        // sequence number within its hop.
+        Encode(ttl, seq int) ([]byte, error)
+
+        // Match reports whether a reply belongs to the probe with the
+        // given payload, based on the part of the payload quoted in the
+        // reply. Replies which do not match are ignored, e.g. late
+        // replies to a previous probe of the same hop.
+        Match(payload, quoted []byte) bool
+}
+
+// Length of the nonce of Options.UniquePayloadPerProbe
+const nonceLength = 8
+
+// The built-in encoder of UDP probes, which sends payloads of
+// Options.PacketLength bytes. The payload is zero-filled, or random if
+// Options.RandomizePayload is set. With Options.UniquePayloadPerProbe
+// it starts with a random nonce.
+type udpEncoder struct {
+        tracer *Tracer
+}
+
+// Encode implements the ProbeEncoder interface.
+func (e *udpEncoder) Encode(ttl, seq int) ([]byte, error) {
+        b := make([]byte, e.tracer.opts.PacketLength)
+        switch {
+        case e.tracer.opts.RandomizePayload:
+                e.tracer.randRead(b)
+        case e.tracer.opts.UniquePayloadPerProbe:
+                if len(b) > nonceLength {
+                        e.tracer.randRead(b[:nonceLength])
+                } else {
+                        e.tracer.randRead(b)
+                }
+        }
+
+        return b, nil
+}
+
+// Match implements the ProbeEncoder interface. Only the common prefix
+// of the payload and the quoted data is compared, since the hop may
+// quote less than the whole payload, or more of it, e.g. the padding
+// and extension objects of RFC 4884 replies.
+func (e *udpEncoder) Match(payload, quoted []byte) bool {
+        n := len(payload)
+        if len(quoted) < n {
+                n = len(quoted)
+        }
+
+        return bytes.Equal(payload[:n], quoted[:n])
+}
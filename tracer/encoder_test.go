@@ -0,0 +1,110 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "bytes"
+        "testing"
+)
+
+func TestUDPEncoderEncode(t *testing.T) {
+        tests := []struct {
+                name   string
+                opts   Options
+                zeroes int // number of trailing zero bytes
+        }{
+                {"zero-filled", Options{PacketLength: 60}, 60},
+                {"random", Options{PacketLength: 60, RandomizePayload: true}, 0},
+                {"unique", Options{PacketLength: 60, UniquePayloadPerProbe: true}, 60 - nonceLength},
+                {"unique-short", Options{PacketLength: 4, UniquePayloadPerProbe: true}, 0},
+                {"empty", Options{PacketLength: 0}, 0},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        opts := tc.opts
+                        opts.RandSeed = 1
+                        e := New(&opts).encoder
+
+                        first, err := e.Encode(1, 0)
+                        if err != nil {
+                                t.Fatalf("Encode: %v", err)
+                        }
+                        second, err := e.Encode(1, 1)
+                        if err != nil {
+                                t.Fatalf("Encode: %v", err)
+                        }
+                        if len(first) != opts.PacketLength {
+                                t.Fatalf("got %d bytes, want %d", len(first), opts.PacketLength)
+                        }
+
+                        tail := first[len(first)-tc.zeroes:]
+                        if !bytes.Equal(tail, make([]byte, tc.zeroes)) {
+                                t.Errorf("got payload %x, want %d trailing zero bytes", first, tc.zeroes)
+                        }
+                        random := len(first) - tc.zeroes
+                        if random > 0 && bytes.Equal(first[:random], second[:random]) {
+                                t.Errorf("got the same random prefix %x twice", first[:random])
+                        }
+                        if !e.Match(first, first) {
+                                t.Errorf("payload %x does not match itself", first)
+                        }
+                })
+        }
+}
+
+func TestUDPEncoderMatch(t *testing.T) {
+        payload := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+        // RFC 4884 pads the quoted datagram to 128 bytes, followed by
+        // the extension objects, e.g. an MPLS label stack
+        extended := make([]byte, 128, 140)
+        copy(extended, payload)
+        extended = append(extended, 0x20, 0, 0, 0, 0, 8, 1, 1, 0, 0, 0x11, 0xff)
+
+        tests := []struct {
+                name   string
+                quoted []byte
+                want   bool
+        }{
+                {"exact", payload, true},
+                {"truncated", payload[:4], true},
+                {"extended", extended, true},
+                {"empty", nil, true},
+                {"different", []byte{1, 2, 3, 4, 5, 6, 7, 9}, false},
+                {"different-truncated", []byte{2, 2}, false},
+                {"different-extended", append([]byte{9}, extended[1:]...), false},
+        }
+
+        e := New(&Options{PacketLength: len(payload)}).encoder
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        if got := e.Match(payload, tc.quoted); got != tc.want {
+                                t.Errorf("Match(%x, %x) = %v, want %v", payload, tc.quoted, got, tc.want)
+                        }
+                })
+        }
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "fmt"
+        "io"
+        "net"
+        "strings"
+        "time"
+)
+
+// FormatOptions controls the columns of the classic text output
+// produced by FormatResult.
+type FormatOptions struct {
+        // ShowNames specifies whether to show the names of the hops,
+        // which requires Options.ResolveNames to be set when tracing
+        ShowNames bool
+
+        // ShowASN specifies whether to show the AS number of the hops,
+        // as returned by LookupASN
+        ShowASN bool
+
+        // ShowLoss specifies whether to show the loss percentage of the
+        // hops
+        ShowLoss bool
+
+        // ShowRTT specifies whether to show the RTT of each probe
+        ShowRTT bool
+
+        // LookupASN returns the AS number of the given hop, e.g. "AS15169",
+        // or an empty string if unknown. It is required for ShowASN.
+        LookupASN func(hop Hop) string
+}
+
+// DefaultFormatOptions provides the default columns of FormatResult
+var DefaultFormatOptions = &FormatOptions{
+        ShowNames: true,
+        ShowLoss:  true,
+        ShowRTT:   true,
+}
+
+// FormatResult writes the result in the classic traceroute text
+// format, with one line per hop and the columns selected by opts. The
+// columns are aligned to the widest value, so that IPv6 addresses and
+// long names do not break the layout.
+func FormatResult(w io.Writer, r *Result, opts *FormatOptions) error {
+        if opts == nil {
+                opts = DefaultFormatOptions
+        }
+
+        rows := make([][]string, 0, len(r.Hops))
+        for _, hop := range r.Hops {
+                row := []string{fmt.Sprintf("%d", hop.TTL), "*"}
+                if len(hop.Addresses) > 0 {
+                        addrs := make([]string, 0, len(hop.Addresses))
+                        for _, addr := range hop.Addresses {
+                                addrs = append(addrs, addr.Addr.String())
+                        }
+                        row[1] = strings.Join(addrs, ", ")
+                } else if hop.Addr != nil {
+                        row[1] = hop.Addr.String()
+                }
+                if opts.ShowNames {
+                        row = append(row, orDash(hop.Name))
+                }
+                if opts.ShowASN {
+                        asn := ""
+                        if opts.LookupASN != nil && hop.Addr != nil {
+                                asn = opts.LookupASN(hop)
+                        }
+                        row = append(row, orDash(asn))
+                }
+                if opts.ShowLoss {
+                        row = append(row, fmt.Sprintf("%.1f%%", hop.Stats.Loss))
+                }
+                if opts.ShowRTT {
+                        rtts := make([]string, 0, len(hop.Probes))
+                        for _, p := range hop.Probes {
+                                if !p.Responded() {
+                                        rtts = append(rtts, "*")
+                                        continue
+                                }
+                                rtts = append(rtts, fmt.Sprintf("%.3f ms", float64(p.RTT().Microseconds())/1000))
+                        }
+                        row = append(row, strings.Join(rtts, "  "))
+                }
+                rows = append(rows, row)
+        }
+
+        // Align all columns except the last one
+        widths := make([]int, 0)
+        for _, row := range rows {
+                for i, col := range row {
+                        if i >= len(widths) {
+                                widths = append(widths, 0)
+                        }
+                        if len(col) > widths[i] {
+                                widths[i] = len(col)
+                        }
+                }
+        }
+
+        for _, row := range rows {
+                cols := make([]string, len(row))
+                for i, col := range row {
+                        if i == len(row)-1 {
+                                cols[i] = col
+                                continue
+                        }
+                        cols[i] = fmt.Sprintf("%-*s", widths[i], col)
+                }
+                if _, err := fmt.Fprintln(w, strings.Join(cols, "  ")); err != nil {
+                        return err
+                }
+        }
+
+        return nil
+}
+
+// Summary returns a single line summary of the result for logging,
+// e.g. "traceroute to 192.0.2.1: reached in 14 hops, 12.3ms, 0% loss".
+// The RTT and loss are the ones of the destination. An unreached
+// destination is summarized by the last probed hop and whether the
+// path went silent before it ("filtered"), or still responded at the
+// maximum TTL ("max hops exceeded").
+func (r *Result) Summary() string {
+        prefix := fmt.Sprintf("traceroute to %s: ", r.Destination)
+        if len(r.Hops) == 0 {
+                return prefix + "no hops probed"
+        }
+
+        last := r.Hops[len(r.Hops)-1]
+        if r.Reached && r.DestinationRTT != nil {
+                return prefix + fmt.Sprintf("reached in %d hops, %s, %.0f%% loss",
+                        last.TTL, r.DestinationRTT.Avg.Round(100*time.Microsecond), r.DestinationRTT.Loss)
+        }
+
+        lastResponding := 0
+        for _, hop := range r.Hops {
+                if hop.Stats.Received > 0 {
+                        lastResponding = hop.TTL
+                }
+        }
+        switch {
+        case lastResponding == 0:
+                return prefix + fmt.Sprintf("not reached, stopped at hop %d, no responses", last.TTL)
+        case lastResponding < last.TTL:
+                return prefix + fmt.Sprintf("not reached, stopped at hop %d, filtered after hop %d", last.TTL, lastResponding)
+        default:
+                return prefix + fmt.Sprintf("not reached, stopped at hop %d, max hops exceeded", last.TTL)
+        }
+}
+
+// HopRow is a row of the mtr style table returned by Result.Table.
+type HopRow struct {
+        // TTL of the hop
+        TTL int `json:"ttl"`
+
+        // Host is the name of the hop if it was resolved, its address
+        // otherwise, or "???" if none of the probes received a response
+        Host string `json:"host"`
+
+        // Addr is the address of the hop, or nil if none of the probes
+        // received a response
+        Addr net.IP `json:"addr"`
+
+        // Loss percentage of the hop
+        Loss float64 `json:"loss"`
+
+        // Number of probes sent to the hop
+        Sent int `json:"sent"`
+
+        // RTT of the last retained probe which received a response
+        Last time.Duration `json:"last"`
+
+        // Average, minimum and maximum RTT of the hop
+        Avg   time.Duration `json:"avg"`
+        Best  time.Duration `json:"best"`
+        Worst time.Duration `json:"worst"`
+
+        // Jitter is the standard deviation of the RTT of the hop, i.e.
+        // the StDev column of mtr
+        Jitter time.Duration `json:"jitter"`
+}
+
+// Table returns a row per hop with the columns printed by mtr, built
+// from the statistics of the hops.
+func (r *Result) Table() []HopRow {
+        rows := make([]HopRow, 0, len(r.Hops))
+        for _, hop := range r.Hops {
+                row := HopRow{
+                        TTL:    hop.TTL,
+                        Host:   "???",
+                        Addr:   hop.Addr,
+                        Loss:   hop.Stats.Loss,
+                        Sent:   hop.Stats.Sent,
+                        Avg:    hop.Stats.Avg,
+                        Best:   hop.Stats.Min,
+                        Worst:  hop.Stats.Max,
+                        Jitter: hop.Stats.StdDev,
+                }
+                switch {
+                case hop.Name != "":
+                        row.Host = hop.Name
+                case hop.Addr != nil:
+                        row.Host = hop.Addr.String()
+                }
+                for _, p := range hop.Probes {
+                        if p.Responded() {
+                                row.Last = p.RTT()
+                        }
+                }
+                rows = append(rows, row)
+        }
+
+        return rows
+}
+
+// HopNodeID returns a stable identifier of the hop with the given
+// address and TTL, which is valid as a node ID in the DOT language,
+// e.g. "hop_5_192_168_1_1". Probes without a response share the ID
+// "hop_<ttl>_star" for their TTL.
+func HopNodeID(ip net.IP, ttl int) string {
+        if ip == nil || ip.IsUnspecified() {
+                return fmt.Sprintf("hop_%d_star", ttl)
+        }
+
+        addr := strings.NewReplacer(".", "_", ":", "_").Replace(ip.String())
+        return fmt.Sprintf("hop_%d_%s", ttl, addr)
+}
+
+// Returns the given string, or a dash if it is empty
+func orDash(s string) string {
+        if s == "" {
+                return "-"
+        }
+
+        return s
+}
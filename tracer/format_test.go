@@ -0,0 +1,84 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "net"
+        "testing"
+        "time"
+)
+
+// Returns the probes of a trace starting at TTL 1, with a probe per
+// given hop address, where nil represents a probe without a response.
+// Each response arrives 12.34ms after its probe was sent.
+func traceProbes(dest net.IP, hops ...net.IP) []Probe {
+        start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+        probes := make([]Probe, len(hops))
+        for i, hop := range hops {
+                p := Probe{TTL: i + 1, Hop: net.IPv4zero, Start: start, End: start.Add(time.Second)}
+                if hop != nil {
+                        p.Hop = hop
+                        p.End = start.Add(12340 * time.Microsecond)
+                        p.Reached = hop.Equal(dest)
+                }
+                probes[i] = p
+        }
+
+        return probes
+}
+
+func TestSummary(t *testing.T) {
+        dest := net.IPv4(198, 51, 100, 1)
+        gw := net.IPv4(192, 0, 2, 1)
+        core := net.IPv4(203, 0, 113, 1)
+
+        tests := []struct {
+                name   string
+                probes []Probe
+                want   string
+        }{
+                {"reached", traceProbes(dest, gw, core, dest),
+                        "traceroute to 198.51.100.1: reached in 3 hops, 12.3ms, 0% loss"},
+                {"reached with loss", append(traceProbes(dest, gw, dest), traceProbes(dest, nil, nil)...),
+                        "traceroute to 198.51.100.1: reached in 2 hops, 12.3ms, 50% loss"},
+                {"no hops", nil,
+                        "traceroute to 198.51.100.1: no hops probed"},
+                {"no responses", traceProbes(dest, nil, nil, nil),
+                        "traceroute to 198.51.100.1: not reached, stopped at hop 3, no responses"},
+                {"filtered", traceProbes(dest, gw, core, nil, nil),
+                        "traceroute to 198.51.100.1: not reached, stopped at hop 4, filtered after hop 2"},
+                {"max hops exceeded", traceProbes(dest, gw, nil, core),
+                        "traceroute to 198.51.100.1: not reached, stopped at hop 3, max hops exceeded"},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        if got := NewResult(dest, tc.probes).Summary(); got != tc.want {
+                                t.Errorf("got %q, want %q", got, tc.want)
+                        }
+                })
+        }
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "net"
+)
+
+// Edge represents an observed transition between two responding hops
+// of a trace.
+type Edge struct {
+        // From is the address of the hop closer to us
+        From net.IP `json:"from"`
+
+        // To is the address of the hop further away
+        To net.IP `json:"to"`
+
+        // TTLs of the two hops. TTLTo is greater than TTLFrom + 1, if
+        // the hops in between did not respond.
+        TTLFrom int `json:"ttl_from"`
+        TTLTo   int `json:"ttl_to"`
+}
+
+// Edges returns the transitions between the hops of the result as an
+// adjacency list, e.g. for feeding into a graph library. Each address
+// responding at a TTL is connected to each address responding at the
+// next responding TTL, so that branches caused by load balancing show
+// up as multiple edges. Hops without a response are bridged, i.e. the
+// edge spans the gap from the last responding TTL before it.
+func (r *Result) Edges() []Edge {
+        edges := make([]Edge, 0)
+
+        var prev []net.IP
+        prevTTL := 0
+        for _, hop := range r.Hops {
+                addrs := hopAddrs(hop)
+                if len(addrs) == 0 {
+                        continue
+                }
+                for _, from := range prev {
+                        for _, to := range addrs {
+                                edges = append(edges, Edge{From: from, To: to, TTLFrom: prevTTL, TTLTo: hop.TTL})
+                        }
+                }
+                prev = addrs
+                prevTTL = hop.TTL
+        }
+
+        return edges
+}
+
+// Returns the unique addresses, which responded to the probes of the
+// hop, in the order of their first response
+func hopAddrs(hop Hop) []net.IP {
+        seen := make(map[string]bool)
+        addrs := make([]net.IP, 0)
+        if hop.Addr != nil {
+                seen[hop.Addr.String()] = true
+                addrs = append(addrs, hop.Addr)
+        }
+        for _, addr := range hop.Addresses {
+                if seen[addr.Addr.String()] {
+                        continue
+                }
+                seen[addr.Addr.String()] = true
+                addrs = append(addrs, addr.Addr)
+        }
+        for _, p := range hop.Probes {
+                if !p.Responded() || seen[p.Hop.String()] {
+                        continue
+                }
+                seen[p.Hop.String()] = true
+                addrs = append(addrs, p.Hop)
+        }
+
+        return addrs
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build go1.23
+
+package tracer
+
+import (
+        "context"
+        "iter"
+        "net"
+)
+
+// Iter traces the hops between us and the destination and returns an
+// iterator over the probes, which can be used with a range loop.
+// Breaking out of the loop stops the trace and releases its
+// resources before the loop statement completes.
+func (t *Tracer) Iter(ctx context.Context, dest net.IP) iter.Seq[Probe] {
+        return func(yield func(Probe) bool) {
+                ctx, cancel := context.WithCancel(ctx)
+                defer cancel()
+
+                ch := t.Trace(ctx, dest)
+                for probe := range ch {
+                        if !yield(probe) {
+                                cancel()
+                                break
+                        }
+                }
+
+                // Drain any remaining probes, so that the prober can
+                // observe the cancellation and exit
+                for range ch {
+                }
+        }
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "net"
+        "sort"
+        "sync"
+)
+
+// Default number of distinct TTLs at which the same address may
+// respond, before the path is considered to loop
+const defaultLoopThreshold = 2
+
+// RoutingLoop describes a routing loop detected during a trace.
+type RoutingLoop struct {
+        // Addr is the address which responded at more TTLs than
+        // Options.LoopThreshold allows
+        Addr net.IP `json:"addr"`
+
+        // TTLs at which the address responded, in ascending order
+        TTLs []int `json:"ttls"`
+}
+
+// Tracks the TTLs at which the addresses of a trace responded, in
+// order to detect routing loops. It is safe for concurrent use, since
+// the hops of a trace may be probed in the background.
+type loopDetector struct {
+        mu        sync.Mutex
+        threshold int
+        ttls      map[string][]int
+        loop      *RoutingLoop
+}
+
+// Creates a new loopDetector, which reports a loop once an address
+// responded at more than threshold distinct TTLs. A threshold of zero
+// or less uses defaultLoopThreshold.
+func newLoopDetector(threshold int) *loopDetector {
+        if threshold <= 0 {
+                threshold = defaultLoopThreshold
+        }
+
+        return &loopDetector{
+                threshold: threshold,
+                ttls:      make(map[string][]int),
+        }
+}
+
+// Records the responding probe, and returns true if its address has
+// now responded at more distinct TTLs than the threshold. Repeated
+// responses at the same TTL are counted once, so that the probes of a
+// single hop never make up a loop. Probes which reached the
+// destination are ignored, since it responds at every TTL beyond its
+// distance, e.g. with Options.RandomizeTTLOrder. Only the first loop
+// is retained.
+func (d *loopDetector) add(p Probe) bool {
+        if !p.Responded() || p.Reached {
+                return false
+        }
+
+        d.mu.Lock()
+        defer d.mu.Unlock()
+
+        key := p.Hop.String()
+        ttls := d.ttls[key]
+        for _, ttl := range ttls {
+                if ttl == p.TTL {
+                        return false
+                }
+        }
+        ttls = append(ttls, p.TTL)
+        d.ttls[key] = ttls
+        if len(ttls) <= d.threshold {
+                return false
+        }
+
+        if d.loop == nil {
+                sorted := append([]int(nil), ttls...)
+                sort.Ints(sorted)
+                d.loop = &RoutingLoop{Addr: p.Hop, TTLs: sorted}
+        }
+
+        return true
+}
+
+// Returns the first loop detected, or nil if there is none.
+func (d *loopDetector) detected() *RoutingLoop {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+
+        return d.loop
+}
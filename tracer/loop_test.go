@@ -0,0 +1,136 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "net"
+        "reflect"
+        "testing"
+)
+
+func TestLoopDetector(t *testing.T) {
+        a := net.IPv4(192, 0, 2, 1)
+        b := net.IPv4(192, 0, 2, 2)
+        dest := net.IPv4(198, 51, 100, 1)
+
+        // Returns the given number of probes per TTL from the given
+        // address
+        hops := func(addr net.IP, from, to, probes int, reached bool) []Probe {
+                ps := make([]Probe, 0)
+                for ttl := from; ttl <= to; ttl++ {
+                        for i := 0; i < probes; i++ {
+                                ps = append(ps, Probe{TTL: ttl, Hop: addr, Reached: reached})
+                        }
+                }
+                return ps
+        }
+
+        tests := []struct {
+                name      string
+                threshold int
+                probes    []Probe
+                want      *RoutingLoop
+                detectTTL int
+        }{
+                {
+                        name:      "loop at TTLs 5-10",
+                        probes:    hops(a, 5, 10, 3, false),
+                        want:      &RoutingLoop{Addr: a, TTLs: []int{5, 6, 7}},
+                        detectTTL: 7,
+                },
+                {
+                        name:      "custom threshold",
+                        threshold: 4,
+                        probes:    hops(a, 5, 10, 3, false),
+                        want:      &RoutingLoop{Addr: a, TTLs: []int{5, 6, 7, 8, 9}},
+                        detectTTL: 9,
+                },
+                {
+                        name: "alternating routers",
+                        probes: []Probe{
+                                {TTL: 1, Hop: a},
+                                {TTL: 2, Hop: b},
+                                {TTL: 3, Hop: a},
+                                {TTL: 4, Hop: b},
+                                {TTL: 5, Hop: a},
+                                {TTL: 6, Hop: b},
+                        },
+                        want:      &RoutingLoop{Addr: a, TTLs: []int{1, 3, 5}},
+                        detectTTL: 5,
+                },
+                {
+                        name:   "router at two TTLs",
+                        probes: hops(a, 5, 6, 3, false),
+                },
+                {
+                        name:   "single hop",
+                        probes: hops(a, 5, 5, 10, false),
+                },
+                {
+                        name:   "stars",
+                        probes: hops(net.IPv4zero, 5, 10, 3, false),
+                },
+                {
+                        name:   "destination beyond its distance",
+                        probes: append(hops(a, 1, 1, 1, false), hops(dest, 2, 10, 3, true)...),
+                },
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        d := newLoopDetector(tc.threshold)
+                        detected := 0
+                        for _, p := range tc.probes {
+                                if d.add(p) && detected == 0 {
+                                        detected = p.TTL
+                                }
+                        }
+
+                        if got := d.detected(); !reflect.DeepEqual(got, tc.want) {
+                                t.Errorf("got loop %+v, want %+v", got, tc.want)
+                        }
+                        if detected != tc.detectTTL {
+                                t.Errorf("loop detected at TTL %d, want %d", detected, tc.detectTTL)
+                        }
+                })
+        }
+}
+
+func TestTraceStateStopsAtLoop(t *testing.T) {
+        a := net.IPv4(192, 0, 2, 1)
+        s := New(&Options{DetectLoops: true}).newTraceState()
+
+        for ttl := 5; ttl <= 10; ttl++ {
+                probe := Probe{TTL: ttl, Hop: a}
+                s.observe(&probe)
+                if want := ttl >= 7; probe.Looped != (ttl == 7) || s.done() != want {
+                        t.Fatalf("TTL %d: got Looped %v and done %v", ttl, probe.Looped, s.done())
+                }
+                if s.done() {
+                        break
+                }
+        }
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "errors"
+        "fmt"
+        "math"
+        "sort"
+        "time"
+)
+
+// MergeResults consolidates the results of repeated traces to the same
+// destination into a single result. The hops are aligned by TTL, and
+// their statistics are aggregated over all of the results, weighting
+// the RTTs by the number of responses. Every address which responded
+// at a TTL in any of the results is kept in Hop.Addresses with its
+// aggregated statistics, so a path which changed in between the traces
+// shows up as multiple addresses of the affected hops. The probes of
+// each hop are concatenated in the order of the results. A hop is
+// confirmed or probably rate limited, and the destination is reached,
+// if so in any of the results. Incremental RTTs are not merged.
+func MergeResults(results []*Result) (*Result, error) {
+        if len(results) == 0 {
+                return nil, errors.New("no results to merge")
+        }
+        for i, r := range results {
+                if r == nil {
+                        return nil, fmt.Errorf("result %d is nil", i)
+                }
+        }
+
+        first := results[0]
+        merged := &Result{
+                Destination: first.Destination,
+                Method:      first.Method,
+                Privileged:  first.Privileged,
+                Hops:        make([]Hop, 0),
+        }
+        hops := make(map[int]*hopMerger)
+        destStats := make([]HopStats, 0)
+        for i, r := range results {
+                if !r.Destination.Equal(first.Destination) {
+                        return nil, fmt.Errorf("result %d is for destination %s instead of %s", i, r.Destination, first.Destination)
+                }
+                if merged.Start.IsZero() || (!r.Start.IsZero() && r.Start.Before(merged.Start)) {
+                        merged.Start = r.Start
+                }
+                if r.End.After(merged.End) {
+                        merged.End = r.End
+                }
+                if r.Reached {
+                        merged.Reached = true
+                }
+                if r.DestinationRTT != nil {
+                        destStats = append(destStats, *r.DestinationRTT)
+                }
+
+                for _, hop := range r.Hops {
+                        m, ok := hops[hop.TTL]
+                        if !ok {
+                                m = newHopMerger(hop.TTL)
+                                hops[hop.TTL] = m
+                        }
+                        m.add(hop)
+                }
+        }
+
+        for _, m := range hops {
+                merged.Hops = append(merged.Hops, m.build())
+        }
+        sort.Slice(merged.Hops, func(i, j int) bool {
+                return merged.Hops[i].TTL < merged.Hops[j].TTL
+        })
+        if len(destStats) > 0 {
+                stats := mergeStats(destStats)
+                merged.DestinationRTT = &stats
+        }
+        merged.computeDarkness()
+
+        return merged, nil
+}
+
+// Merges the hops with the same TTL of multiple results
+type hopMerger struct {
+        hop   Hop
+        stats []HopStats
+
+        // Index of each address in addrs, and the statistics of the
+        // address from each of the hops
+        index map[string]int
+        addrs [][]AddrStats
+}
+
+// Creates a new merger of the hops with the given TTL
+func newHopMerger(ttl int) *hopMerger {
+        m := &hopMerger{
+                hop: Hop{
+                        TTL:    ttl,
+                        Probes: make([]Probe, 0),
+                },
+                index: make(map[string]int),
+        }
+
+        return m
+}
+
+// Adds a hop to the merged hop
+func (m *hopMerger) add(hop Hop) {
+        if m.hop.Addr == nil && hop.Addr != nil {
+                m.hop.Addr = hop.Addr
+                m.hop.Name = hop.Name
+                m.hop.ReplyTTL = hop.ReplyTTL
+        }
+        if hop.Confirmed {
+                m.hop.Confirmed = true
+        }
+        if hop.ProbableRateLimit && !m.hop.ProbableRateLimit {
+                m.hop.ProbableRateLimit = true
+                m.hop.EstimatedRate = hop.EstimatedRate
+        }
+        m.hop.Probes = append(m.hop.Probes, hop.Probes...)
+        m.stats = append(m.stats, hop.Stats)
+
+        for _, addr := range hop.Addresses {
+                i, ok := m.index[addr.Addr.String()]
+                if !ok {
+                        i = len(m.addrs)
+                        m.index[addr.Addr.String()] = i
+                        m.addrs = append(m.addrs, nil)
+                }
+                m.addrs[i] = append(m.addrs[i], addr)
+        }
+}
+
+// Returns the merged hop
+func (m *hopMerger) build() Hop {
+        hop := m.hop
+        hop.Stats = mergeStats(m.stats)
+        if hop.Stats.Sent > 0 {
+                hop.ResponseRatio = float64(hop.Stats.Received) / float64(hop.Stats.Sent)
+        }
+
+        hop.Addresses = make([]AddrStats, 0, len(m.addrs))
+        for _, all := range m.addrs {
+                hop.Addresses = append(hop.Addresses, mergeAddrStats(all))
+        }
+        hop.Diverged = len(hop.Addresses) > 1
+
+        return hop
+}
+
+// Aggregates the statistics of a hop over multiple results. The
+// standard deviation is pooled from the means and deviations of each.
+func mergeStats(all []HopStats) HopStats {
+        var merged HopStats
+        var sum, sumSquares float64
+        for _, s := range all {
+                merged.Sent += s.Sent
+                if s.Received == 0 {
+                        continue
+                }
+                if merged.Received == 0 || s.Min < merged.Min {
+                        merged.Min = s.Min
+                }
+                if s.Max > merged.Max {
+                        merged.Max = s.Max
+                }
+                merged.Received += s.Received
+
+                n, avg, stddev := float64(s.Received), float64(s.Avg), float64(s.StdDev)
+                sum += n * avg
+                sumSquares += n * (stddev*stddev + avg*avg)
+        }
+
+        if merged.Sent > 0 {
+                merged.Loss = float64(merged.Sent-merged.Received) / float64(merged.Sent) * 100
+        }
+        if merged.Received > 0 {
+                n := float64(merged.Received)
+                mean := sum / n
+                merged.Avg = time.Duration(mean)
+                merged.StdDev = time.Duration(math.Sqrt(math.Max(sumSquares/n-mean*mean, 0)))
+        }
+
+        return merged
+}
+
+// Aggregates the statistics of an address over multiple results
+func mergeAddrStats(all []AddrStats) AddrStats {
+        merged := AddrStats{Addr: all[0].Addr}
+        var sum time.Duration
+        for _, s := range all {
+                if s.Received == 0 {
+                        continue
+                }
+                if merged.Received == 0 || s.Min < merged.Min {
+                        merged.Min = s.Min
+                }
+                if s.Max > merged.Max {
+                        merged.Max = s.Max
+                }
+                merged.Received += s.Received
+                sum += s.Avg * time.Duration(s.Received)
+        }
+        if merged.Received > 0 {
+                merged.Avg = sum / time.Duration(merged.Received)
+        }
+
+        return merged
+}
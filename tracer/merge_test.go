@@ -0,0 +1,133 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "net"
+        "testing"
+        "time"
+)
+
+func TestMergeResults(t *testing.T) {
+        start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+        dest := net.IPv4(198, 51, 100, 1)
+        gw := net.IPv4(192, 0, 2, 1)
+        a, b := net.IPv4(203, 0, 113, 1), net.IPv4(203, 0, 113, 2)
+
+        // Returns the result of a trace with a probe per given hop,
+        // which all responded after the given RTT, except for nil hops
+        result := func(rtt time.Duration, hops ...net.IP) *Result {
+                probes := traceProbes(dest, hops...)
+                for i := range probes {
+                        if probes[i].Responded() {
+                                probes[i].End = start.Add(rtt)
+                        }
+                }
+                return NewResult(dest, probes)
+        }
+        ms := time.Millisecond
+
+        merged, err := MergeResults([]*Result{
+                result(10*ms, gw, a, dest),
+                result(20*ms, gw, b, nil, nil, nil),
+        })
+        if err != nil {
+                t.Fatalf("MergeResults: %v", err)
+        }
+        if !merged.Reached || merged.DestinationRTT == nil || merged.DestinationRTT.Sent != 1 {
+                t.Errorf("got reached %v with %+v, want the destination reached once", merged.Reached, merged.DestinationRTT)
+        }
+        if merged.FirstDarkTTL != -1 {
+                t.Errorf("got FirstDarkTTL %d, want -1", merged.FirstDarkTTL)
+        }
+
+        tests := []struct {
+                ttl      int
+                addrs    []net.IP
+                received int
+                sent     int
+                avg      time.Duration
+                stddev   time.Duration
+        }{
+                {1, []net.IP{gw}, 2, 2, 15 * ms, 5 * ms},
+                {2, []net.IP{a, b}, 2, 2, 15 * ms, 5 * ms},
+                {3, []net.IP{dest}, 1, 2, 10 * ms, 0},
+                {4, []net.IP{}, 0, 1, 0, 0},
+                {5, []net.IP{}, 0, 1, 0, 0},
+        }
+        if len(merged.Hops) != len(tests) {
+                t.Fatalf("got %d hops, want %d", len(merged.Hops), len(tests))
+        }
+        for i, tc := range tests {
+                hop := merged.Hops[i]
+                if hop.TTL != tc.ttl {
+                        t.Errorf("hop %d has TTL %d, want %d", i, hop.TTL, tc.ttl)
+                        continue
+                }
+                if len(hop.Addresses) != len(tc.addrs) {
+                        t.Errorf("hop %d has addresses %+v, want %v", tc.ttl, hop.Addresses, tc.addrs)
+                } else {
+                        for j, addr := range tc.addrs {
+                                if !hop.Addresses[j].Addr.Equal(addr) {
+                                        t.Errorf("hop %d has address %v at %d, want %v", tc.ttl, hop.Addresses[j].Addr, j, addr)
+                                }
+                        }
+                }
+                if hop.Diverged != (len(tc.addrs) > 1) {
+                        t.Errorf("hop %d has Diverged %v with %d addresses", tc.ttl, hop.Diverged, len(tc.addrs))
+                }
+                s := hop.Stats
+                if s.Received != tc.received || s.Sent != tc.sent || len(hop.Probes) != tc.sent {
+                        t.Errorf("hop %d has %d of %d received with %d probes, want %d of %d", tc.ttl, s.Received, s.Sent, len(hop.Probes), tc.received, tc.sent)
+                }
+                if s.Avg != tc.avg || s.StdDev != tc.stddev {
+                        t.Errorf("hop %d has avg %v and stddev %v, want %v and %v", tc.ttl, s.Avg, s.StdDev, tc.avg, tc.stddev)
+                }
+                if ratio := float64(tc.received) / float64(tc.sent); hop.ResponseRatio != ratio {
+                        t.Errorf("hop %d has a response ratio of %v, want %v", tc.ttl, hop.ResponseRatio, ratio)
+                }
+        }
+}
+
+func TestMergeResultsErrors(t *testing.T) {
+        dest := net.IPv4(198, 51, 100, 1)
+        tests := []struct {
+                name    string
+                results []*Result
+        }{
+                {"no results", nil},
+                {"nil result", []*Result{NewResult(dest, nil), nil}},
+                {"other destination", []*Result{NewResult(dest, nil), NewResult(net.IPv4(198, 51, 100, 2), nil)}},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        if _, err := MergeResults(tc.results); err == nil {
+                                t.Error("got no error")
+                        }
+                })
+        }
+}
@@ -0,0 +1,496 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "net"
+        "sort"
+        "sync"
+        "time"
+)
+
+// Cycle represents a single iteration of a Monitor.
+type Cycle struct {
+        // Sequence number of the cycle, starting from 1
+        Seq int
+
+        // Result of the trace, or nil if the trace failed
+        Result *Result
+
+        // Reachable is true, if the destination was reached during the
+        // cycle. It is false when the trace failed, or when it ran up to
+        // Options.MaxHops without reaching the destination.
+        Reachable bool
+
+        // Error provides the error which may have occurred during the
+        // trace
+        Error error
+}
+
+// PathEvent represents a notification about the stability of the
+// path, which is delivered to the Monitor hooks.
+type PathEvent struct {
+        // Result of the cycle, which triggered the event
+        Result *Result
+
+        // Number of consecutive cycles with an identical path,
+        // including the current one
+        StableCycles int
+
+        // Hops which have changed since the previous cycle
+        Changes []HopChange
+}
+
+// HopState is the state of a hop accumulated by a Monitor across its
+// cycles.
+type HopState struct {
+        // TTL of the hop
+        TTL int
+
+        // Addr is the address of the first responder to the hop in the
+        // most recent cycle, in which the hop responded
+        Addr net.IP
+
+        // Number of probes sent to and answered by the hop
+        Sent     int
+        Received int
+
+        // Loss percentage of the hop across all cycles
+        Loss float64
+
+        // Min, Max and Avg RTT of the hop across all cycles
+        Min time.Duration
+        Max time.Duration
+        Avg time.Duration
+
+        // LastSeen is the time of the most recent cycle, in which the
+        // hop responded, or zero if it never did
+        LastSeen time.Time
+
+        // Time at which the hop was first recorded, for aging out hops
+        // which never responded
+        since time.Time
+}
+
+// MonitorStats is a snapshot of the statistics accumulated by a
+// Monitor.
+type MonitorStats struct {
+        // Number of completed cycles
+        Cycles int
+
+        // Paused is true, if the Monitor was paused when the snapshot
+        // was taken
+        Paused bool
+
+        // Result of the most recent successful cycle
+        Last *Result
+
+        // Number of successful cycles, which were compared against
+        // the path of their preceding successful cycle, and how many
+        // of them found a different path
+        PathComparisons int
+        PathChanges     int
+
+        // State of the hops, ordered by TTL
+        Hops []HopState
+}
+
+// PathStability returns the fraction of the compared cycles, whose path
+// was identical to the one of their preceding cycle, i.e. 1 for a path
+// which never changed, and 0 for a path which changed on every cycle.
+// A path is identical, if the same TTLs responded from the same sets of
+// addresses. It returns 1, if fewer than two cycles have completed.
+func (s *MonitorStats) PathStability() float64 {
+        if s.PathComparisons == 0 {
+                return 1
+        }
+
+        return float64(s.PathComparisons-s.PathChanges) / float64(s.PathComparisons)
+}
+
+// HopEmitMode controls when the Monitor reports hop updates.
+type HopEmitMode int
+
+const (
+        // HopEmitAlways reports every hop of every cycle
+        HopEmitAlways HopEmitMode = iota
+
+        // HopEmitOnChange reports a hop only when it has changed
+        // meaningfully since it was last reported, i.e. when its set
+        // of addresses has changed, or when its loss or average RTT
+        // have changed by more than Options.LossChangeThreshold or
+        // both of Options.RTTChangeAbsolute and
+        // Options.RTTChangeRelative respectively
+        HopEmitOnChange
+)
+
+// Monitor continuously traces the path to a destination.
+type Monitor struct {
+        // Interval to wait between two consecutive traces
+        Interval time.Duration
+
+        // Number of consecutive cycles with an identical path, after
+        // which the path is considered stable
+        StableCycles int
+
+        // OnStable is invoked once the path has been identical for
+        // StableCycles consecutive cycles. It is invoked again only
+        // after the path has changed and stabilized once more.
+        OnStable func(event PathEvent)
+
+        // OnChange is invoked when the path differs from the path of
+        // the previous cycle.
+        OnChange func(event PathEvent)
+
+        // OnHopUpdate is invoked for the hops of each cycle, as
+        // selected by HopEmitMode.
+        OnHopUpdate func(hop Hop)
+
+        // HopEmitMode controls for which hops OnHopUpdate is invoked
+        HopEmitMode HopEmitMode
+
+        // MaxHopAge specifies for how long the statistics of a hop are
+        // kept after it last responded. Hops which have not responded
+        // within MaxHopAge are dropped from the statistics, e.g. after
+        // the path has changed. A value of zero keeps all hops.
+        MaxHopAge time.Duration
+
+        // Now returns the current time, which is used for LastSeen and
+        // for aging out the hops. It defaults to time.Now.
+        Now func() time.Time
+
+        // Trace runs the trace of a cycle. It defaults to the TraceAll
+        // method of the Tracer, and may be replaced, e.g. for replaying
+        // recorded results.
+        Trace func(ctx context.Context, dest net.IP) (*Result, error)
+
+        tracer *Tracer
+        dest   net.IP
+
+        // Guards the fields below
+        mu sync.Mutex
+
+        // Pause state, and the channel which is closed on resume
+        paused  bool
+        resumed chan struct{}
+
+        // Cancels the cycle in progress
+        cancelCycle context.CancelFunc
+
+        // Accumulated statistics
+        cycles      int
+        last        *Result
+        hops        map[int]*HopState
+        comparisons int
+        changes     int
+}
+
+// NewMonitor creates a new Monitor, which traces the path to the
+// destination using the given Tracer.
+func NewMonitor(t *Tracer, dest net.IP) *Monitor {
+        m := &Monitor{
+                Interval:     time.Second,
+                StableCycles: 3,
+                Now:          time.Now,
+                Trace:        t.TraceAll,
+                tracer:       t,
+                dest:         dest,
+        }
+
+        return m
+}
+
+// Run starts monitoring the destination until the context is done,
+// and sends each completed cycle to the returned channel. The hooks
+// of the Monitor are invoked from the same goroutine, which sends the
+// cycles, so they should not block.
+func (m *Monitor) Run(ctx context.Context) <-chan Cycle {
+        ch := make(chan Cycle)
+
+        monitor := func() {
+                defer close(ch)
+
+                var prev *Result
+                stable := 0
+                reported := make(map[int]Hop)
+                for seq := 1; ; seq++ {
+                        cycleCtx, cancel, ok := m.nextCycle(ctx)
+                        if !ok {
+                                return
+                        }
+                        result, err := m.Trace(cycleCtx, m.dest)
+                        interrupted := cycleCtx.Err() != nil
+                        cancel()
+                        if ctx.Err() != nil {
+                                return
+                        }
+
+                        // The Monitor was paused during the cycle, so
+                        // discard its incomplete result
+                        if interrupted {
+                                seq--
+                                continue
+                        }
+
+                        if err == nil {
+                                stable = m.track(prev, result, stable)
+                                m.reportHops(result, reported)
+                                m.record(result)
+                                prev = result
+                        }
+
+                        cycle := Cycle{
+                                Seq:       seq,
+                                Result:    result,
+                                Reachable: err == nil && result.Reached,
+                                Error:     err,
+                        }
+
+                        select {
+                        case ch <- cycle:
+                        case <-ctx.Done():
+                                return
+                        }
+
+                        select {
+                        case <-time.After(m.Interval):
+                        case <-ctx.Done():
+                                return
+                        }
+                }
+        }
+
+        go monitor()
+        return ch
+}
+
+// Pause stops the Monitor from probing, until Resume is called. A cycle
+// in progress is cancelled and discarded. The accumulated statistics
+// are preserved.
+func (m *Monitor) Pause() {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        if m.paused {
+                return
+        }
+        m.paused = true
+        m.resumed = make(chan struct{})
+        if m.cancelCycle != nil {
+                m.cancelCycle()
+        }
+}
+
+// Resume continues probing after the Monitor has been paused.
+func (m *Monitor) Resume() {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        if !m.paused {
+                return
+        }
+        m.paused = false
+        close(m.resumed)
+}
+
+// Stats returns a snapshot of the statistics accumulated by the
+// Monitor. While the Monitor is paused, the snapshot reflects the
+// state as of the last completed cycle.
+func (m *Monitor) Stats() MonitorStats {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        stats := MonitorStats{
+                Cycles:          m.cycles,
+                Paused:          m.paused,
+                Last:            m.last,
+                PathComparisons: m.comparisons,
+                PathChanges:     m.changes,
+                Hops:            make([]HopState, 0, len(m.hops)),
+        }
+        for _, state := range m.hops {
+                stats.Hops = append(stats.Hops, *state)
+        }
+        sort.Slice(stats.Hops, func(i, j int) bool {
+                return stats.Hops[i].TTL < stats.Hops[j].TTL
+        })
+
+        return stats
+}
+
+// Blocks while the Monitor is paused, and returns the context of the
+// next cycle, which is cancelled if the Monitor gets paused. Returns
+// false, if the given context is done.
+func (m *Monitor) nextCycle(ctx context.Context) (context.Context, context.CancelFunc, bool) {
+        for {
+                m.mu.Lock()
+                if !m.paused {
+                        cycleCtx, cancel := context.WithCancel(ctx)
+                        m.cancelCycle = cancel
+                        m.mu.Unlock()
+                        return cycleCtx, cancel, true
+                }
+                resumed := m.resumed
+                m.mu.Unlock()
+
+                select {
+                case <-resumed:
+                case <-ctx.Done():
+                        return nil, nil, false
+                }
+        }
+}
+
+// Accumulates the hops of the given result into the statistics.
+func (m *Monitor) record(r *Result) {
+        m.mu.Lock()
+        defer m.mu.Unlock()
+
+        if m.hops == nil {
+                m.hops = make(map[int]*HopState)
+        }
+        m.cycles++
+        if m.last != nil {
+                m.comparisons++
+                if !samePath(m.last, r) {
+                        m.changes++
+                }
+        }
+        m.last = r
+
+        now := m.Now()
+        for _, hop := range r.Hops {
+                state, ok := m.hops[hop.TTL]
+                if !ok {
+                        state = &HopState{TTL: hop.TTL, since: now}
+                        m.hops[hop.TTL] = state
+                }
+
+                if hop.Addr != nil {
+                        state.Addr = hop.Addr
+                }
+                if hop.Stats.Received > 0 {
+                        if state.Received == 0 || hop.Stats.Min < state.Min {
+                                state.Min = hop.Stats.Min
+                        }
+                        if hop.Stats.Max > state.Max {
+                                state.Max = hop.Stats.Max
+                        }
+                        total := state.Received + hop.Stats.Received
+                        state.Avg = (state.Avg*time.Duration(state.Received) + hop.Stats.Avg*time.Duration(hop.Stats.Received)) / time.Duration(total)
+                        state.LastSeen = now
+                }
+                state.Sent += hop.Stats.Sent
+                state.Received += hop.Stats.Received
+                if state.Sent > 0 {
+                        state.Loss = float64(state.Sent-state.Received) / float64(state.Sent) * 100
+                }
+        }
+
+        if m.MaxHopAge > 0 {
+                for ttl, state := range m.hops {
+                        seen := state.LastSeen
+                        if seen.IsZero() {
+                                seen = state.since
+                        }
+                        if now.Sub(seen) > m.MaxHopAge {
+                                delete(m.hops, ttl)
+                        }
+                }
+        }
+}
+
+// Compares the current result against the previous one, invokes the
+// hooks and returns the updated number of stable cycles.
+func (m *Monitor) track(prev, curr *Result, stable int) int {
+        changes := PathDiff(prev, curr)
+        if prev != nil && len(changes) > 0 {
+                stable = 1
+                if m.OnChange != nil {
+                        m.OnChange(PathEvent{Result: curr, StableCycles: stable, Changes: changes})
+                }
+        } else {
+                stable++
+        }
+
+        if stable == m.StableCycles && m.OnStable != nil {
+                m.OnStable(PathEvent{Result: curr, StableCycles: stable})
+        }
+
+        return stable
+}
+
+// Invokes the OnHopUpdate hook for the hops of the result, which
+// should be reported according to the HopEmitMode. The reported map
+// keeps the last reported hop per TTL.
+func (m *Monitor) reportHops(r *Result, reported map[int]Hop) {
+        if m.OnHopUpdate == nil {
+                return
+        }
+
+        for _, hop := range r.Hops {
+                last, ok := reported[hop.TTL]
+                if m.HopEmitMode == HopEmitOnChange && ok {
+                        if _, changed := m.tracer.diffHop(&last, &hop); !changed {
+                                continue
+                        }
+                }
+                reported[hop.TTL] = hop
+                m.OnHopUpdate(hop)
+        }
+}
+
+// Returns true, if both results probed the same TTLs, and each of the
+// hops responded from the same set of addresses in both, i.e. PathDiff
+// reports no changes
+func samePath(a, b *Result) bool {
+        return len(PathDiff(a, b)) == 0
+}
+
+// Returns true, if the responding probes of both hops came from the
+// same set of addresses
+func sameAddrs(a, b Hop) bool {
+        addrs := func(h Hop) map[string]bool {
+                set := make(map[string]bool)
+                for _, addr := range hopAddrs(h) {
+                        set[addr.String()] = true
+                }
+                return set
+        }
+
+        setA, setB := addrs(a), addrs(b)
+        if len(setA) != len(setB) {
+                return false
+        }
+        for addr := range setA {
+                if !setB[addr] {
+                        return false
+                }
+        }
+
+        return true
+}
@@ -0,0 +1,255 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "net"
+        "sync/atomic"
+        "testing"
+        "time"
+)
+
+// Returns a result with a hop per element of hops, each holding a probe
+// per responding address. An empty address is a probe without a
+// response.
+func scriptedResult(hops ...[]string) *Result {
+        probes := make([]Probe, 0)
+        for i, addrs := range hops {
+                for _, addr := range addrs {
+                        hop := net.IPv4zero
+                        if addr != "" {
+                                hop = net.ParseIP(addr)
+                        }
+                        probes = append(probes, Probe{TTL: i + 1, Hop: hop})
+                }
+        }
+
+        return NewResult(net.IPv4(198, 51, 100, 1), probes)
+}
+
+// Runs the monitor over the given results, one per cycle, and returns
+// its statistics afterwards
+func replay(t *testing.T, m *Monitor, results []*Result) MonitorStats {
+        t.Helper()
+
+        next := 0
+        m.Interval = 0
+        m.Trace = func(ctx context.Context, dest net.IP) (*Result, error) {
+                if next == len(results) {
+                        <-ctx.Done()
+                        return nil, ctx.Err()
+                }
+                r := results[next]
+                next++
+                return r, nil
+        }
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        ch := m.Run(ctx)
+        for range results {
+                <-ch
+        }
+
+        return m.Stats()
+}
+
+func TestMonitorPathEvents(t *testing.T) {
+        a := scriptedResult([]string{"192.0.2.1", "192.0.2.1"}, []string{"192.0.2.10"})
+        b := scriptedResult([]string{"192.0.2.2", "192.0.2.2"}, []string{"192.0.2.10"})
+        ecmp1 := scriptedResult([]string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.10"})
+        ecmp2 := scriptedResult([]string{"192.0.2.2", "192.0.2.1"}, []string{"192.0.2.10"})
+        dark := scriptedResult([]string{"192.0.2.1", "192.0.2.1"}, []string{"", ""})
+
+        tests := []struct {
+                name      string
+                results   []*Result
+                changes   []int // cycles invoking OnChange
+                stable    []int // cycles invoking OnStable
+                stability float64
+        }{
+                {"stable", []*Result{a, a, a, a}, nil, []int{3}, 1},
+                {"changed", []*Result{a, a, b, b, b}, []int{3}, []int{5}, 0.75},
+                {"flapping", []*Result{a, b, a, b}, []int{2, 3, 4}, nil, 0},
+                {"balanced", []*Result{ecmp1, ecmp2, ecmp1, ecmp2}, nil, []int{3}, 1},
+                {"dark hop", []*Result{a, dark, dark}, []int{2}, nil, 0.5},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        changes := make([]int, 0)
+                        stable := make([]int, 0)
+
+                        // The hooks are invoked before the cycle is
+                        // recorded
+                        m := NewMonitor(New(&Options{}), net.IPv4(198, 51, 100, 1))
+                        m.StableCycles = 3
+                        m.OnChange = func(PathEvent) {
+                                changes = append(changes, m.Stats().Cycles+1)
+                        }
+                        m.OnStable = func(PathEvent) {
+                                stable = append(stable, m.Stats().Cycles+1)
+                        }
+
+                        stats := replay(t, m, tc.results)
+                        if !equalInts(changes, tc.changes) {
+                                t.Errorf("OnChange invoked at cycles %v, want %v", changes, tc.changes)
+                        }
+                        if !equalInts(stable, tc.stable) {
+                                t.Errorf("OnStable invoked at cycles %v, want %v", stable, tc.stable)
+                        }
+                        if stats.PathChanges != len(changes) {
+                                t.Errorf("got %d path changes, but OnChange was invoked %d times", stats.PathChanges, len(changes))
+                        }
+                        if got := stats.PathStability(); got != tc.stability {
+                                t.Errorf("got path stability %v, want %v", got, tc.stability)
+                        }
+                })
+        }
+}
+
+func TestMonitorAging(t *testing.T) {
+        full := scriptedResult([]string{"192.0.2.1"}, []string{"192.0.2.2"}, []string{"192.0.2.3"})
+        short := scriptedResult([]string{"192.0.2.1"}, []string{"192.0.2.2"})
+        partial := scriptedResult([]string{"192.0.2.1"}, []string{""})
+
+        tests := []struct {
+                name    string
+                maxAge  time.Duration
+                results []*Result
+                ttls    []int
+        }{
+                {"kept", 0, []*Result{full, short, short, short}, []int{1, 2, 3}},
+                {"recent", 150 * time.Second, []*Result{full, short, short}, []int{1, 2, 3}},
+                {"aged out", 90 * time.Second, []*Result{full, short, short}, []int{1, 2}},
+                {"dark hop aged out", 90 * time.Second, []*Result{short, partial, partial}, []int{1}},
+                {"dark hop kept", 90 * time.Second, []*Result{short, partial}, []int{1, 2}},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        // Each cycle takes a minute
+                        now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+                        m := NewMonitor(New(&Options{}), net.IPv4(198, 51, 100, 1))
+                        m.MaxHopAge = tc.maxAge
+                        m.Now = func() time.Time {
+                                now = now.Add(time.Minute)
+                                return now
+                        }
+
+                        stats := replay(t, m, tc.results)
+                        ttls := make([]int, 0, len(stats.Hops))
+                        for _, hop := range stats.Hops {
+                                ttls = append(ttls, hop.TTL)
+                        }
+                        if !equalInts(ttls, tc.ttls) {
+                                t.Errorf("got hops %v, want %v", ttls, tc.ttls)
+                        }
+                        if stats.Cycles != len(tc.results) {
+                                t.Errorf("got %d cycles, want %d", stats.Cycles, len(tc.results))
+                        }
+                })
+        }
+}
+
+func equalInts(a, b []int) bool {
+        if len(a) != len(b) {
+                return false
+        }
+        for i := range a {
+                if a[i] != b[i] {
+                        return false
+                }
+        }
+
+        return true
+}
+
+func TestMonitorPauseResume(t *testing.T) {
+        result := scriptedResult([]string{"192.0.2.1"}, []string{"198.51.100.1"})
+        var traces atomic.Int32
+        m := NewMonitor(New(&Options{}), net.IPv4(198, 51, 100, 1))
+        m.Interval = 5 * time.Millisecond
+        m.Trace = func(ctx context.Context, dest net.IP) (*Result, error) {
+                traces.Add(1)
+                return result, nil
+        }
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        cycles := make(chan Cycle, 1000)
+        go func() {
+                for c := range m.Run(ctx) {
+                        cycles <- c
+                }
+        }()
+        receive := func() Cycle {
+                t.Helper()
+                select {
+                case c := <-cycles:
+                        return c
+                case <-time.After(5 * time.Second):
+                        t.Fatal("no cycle completed")
+                        return Cycle{}
+                }
+        }
+
+        receive()
+        receive()
+        m.Pause()
+        paused := traces.Load()
+
+        // A cycle racing the pause may still be recorded
+        time.Sleep(20 * m.Interval)
+        before := m.Stats()
+        time.Sleep(20 * m.Interval)
+        if got := traces.Load(); got != paused {
+                t.Errorf("got %d traces while paused, want none", got-paused)
+        }
+        stats := m.Stats()
+        if !stats.Paused {
+                t.Error("got a snapshot, which is not paused")
+        }
+        if stats.Cycles < 2 || stats.Cycles != before.Cycles || stats.Last != result || len(stats.Hops) != 2 {
+                t.Errorf("got %d cycles with %d hops, want the %d cycles before the pause", stats.Cycles, len(stats.Hops), before.Cycles)
+        }
+        for len(cycles) > 0 {
+                <-cycles
+        }
+
+        m.Resume()
+        c := receive()
+        if c.Seq != stats.Cycles+1 {
+                t.Errorf("got cycle %d after resume, want %d", c.Seq, stats.Cycles+1)
+        }
+        if got := traces.Load(); got <= paused {
+                t.Error("got no traces after resume")
+        }
+        if stats := m.Stats(); stats.Paused || stats.Cycles <= before.Cycles {
+                t.Errorf("got paused %v with %d cycles after resume", stats.Paused, stats.Cycles)
+        }
+}
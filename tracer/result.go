@@ -0,0 +1,700 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "math"
+        "net"
+        "os"
+        "sort"
+        "time"
+)
+
+// HopStats provides statistics about the probes sent to a hop.
+type HopStats struct {
+        // Number of probes sent to the hop, including the ones
+        // without a response, which were not retained nor emitted
+        Sent int `json:"sent"`
+
+        // Number of probes, which received a response
+        Received int `json:"received"`
+
+        // Percentage of probes, which did not receive a response, i.e.
+        // Received out of Sent
+        Loss float64 `json:"loss"`
+
+        // Minimum RTT of the responding probes
+        Min time.Duration `json:"min"`
+
+        // Maximum RTT of the responding probes
+        Max time.Duration `json:"max"`
+
+        // Average RTT of the responding probes
+        Avg time.Duration `json:"avg"`
+
+        // Standard deviation of the RTT of the responding probes
+        StdDev time.Duration `json:"stddev"`
+}
+
+// AddrStats provides statistics about the responses from one of the
+// addresses of a hop.
+type AddrStats struct {
+        // Addr is the responding address
+        Addr net.IP `json:"addr"`
+
+        // Number of responses from the address
+        Received int `json:"received"`
+
+        // Min, Max and Avg RTT of the responses from the address
+        Min time.Duration `json:"min"`
+        Max time.Duration `json:"max"`
+        Avg time.Duration `json:"avg"`
+}
+
+// Hop represents the probes sent with the same TTL.
+type Hop struct {
+        // TTL of the hop
+        TTL int `json:"ttl"`
+
+        // Addr is the IP of the first responding probe, or nil if none
+        // of the probes received a response
+        Addr net.IP `json:"addr"`
+
+        // Addresses provides every distinct address, which responded
+        // to the probes of the hop, in the order of their first
+        // response. Routers balancing the load over multiple paths
+        // cause more than one address per hop.
+        Addresses []AddrStats `json:"addresses,omitempty"`
+
+        // Diverged is true, if the probes of the hop were answered by
+        // more than one address, i.e. the hop is load balanced or its
+        // route flapped while it was probed
+        Diverged bool `json:"diverged"`
+
+        // Name of the hop, if its name was resolved
+        Name string `json:"name,omitempty"`
+
+        // ReplyTTL is the reply TTL of the first responding probe,
+        // or zero if unknown
+        ReplyTTL int `json:"reply_ttl,omitempty"`
+
+        // Probes sent with this TTL
+        Probes []Probe `json:"probes"`
+
+        // Statistics about the probes of the hop
+        Stats HopStats `json:"stats"`
+
+        // Confirmed is true, if at least Options.ConfirmThreshold of the
+        // probes received a response from the same address. Without a
+        // threshold, any response confirms the hop.
+        Confirmed bool `json:"confirmed"`
+
+        // ResponseRatio is the ratio of responses to probes sent to the
+        // hop, over all of the attempts made for it, including the
+        // additional probes of Options.AdaptiveProbes and the probes
+        // which were not retained. A low ratio at a hop whose
+        // successors respond fine usually indicates ICMP rate
+        // limiting, rather than actual packet loss.
+        ResponseRatio float64 `json:"response_ratio"`
+
+        // ProbableRateLimit is true, if the hop lost some of the probes
+        // and the replies it did send are spaced at regular intervals,
+        // as produced by the token bucket of an ICMP rate limiter.
+        // Such a hop is throttled, rather than congested. The check
+        // requires at least three replies among the retained probes,
+        // whose intervals deviate by less than 10% from their mean.
+        ProbableRateLimit bool `json:"probable_rate_limit"`
+
+        // EstimatedRate is the estimated rate of the ICMP rate limiter
+        // in replies per second, if ProbableRateLimit is set
+        EstimatedRate float64 `json:"estimated_rate,omitempty"`
+
+        // IncrementalRTT is the average RTT of the hop minus the
+        // average RTT of the closest preceding responding hop. For the
+        // first responding hop it equals its average RTT. It is only
+        // computed when Options.IncrementalRTT is set.
+        IncrementalRTT time.Duration `json:"incremental_rtt"`
+
+        // RTTAnomaly is true, if the hop has a lower average RTT than
+        // its predecessor, in which case IncrementalRTT is clamped to
+        // zero.
+        RTTAnomaly bool `json:"rtt_anomaly"`
+}
+
+// Result represents the grouped result of a completed trace.
+type Result struct {
+        // Destination of the trace
+        Destination net.IP `json:"destination"`
+
+        // Start time of the trace
+        Start time.Time `json:"start"`
+
+        // End time of the trace
+        End time.Time `json:"end"`
+
+        // Reached is true, if the destination responded to our probes
+        Reached bool `json:"reached"`
+
+        // Method used for the trace
+        Method Method `json:"method"`
+
+        // Privileged is true, if the trace ran as root, i.e. with an
+        // effective user ID of zero. Capabilities such as CAP_NET_RAW
+        // granted to an unprivileged user are not taken into account,
+        // and it is always false on Windows, which has no such ID.
+        Privileged bool `json:"privileged"`
+
+        // Hops to the destination, ordered by TTL
+        Hops []Hop `json:"hops"`
+
+        // DestinationRTT provides the statistics of the hop at which
+        // the destination was reached, or nil if the destination was
+        // not reached
+        DestinationRTT *HopStats `json:"destination_rtt,omitempty"`
+
+        // DirectProbe is the probe sent straight to the destination,
+        // if Options.ProbeDestinationDirectly is set. The destination
+        // is alive, if it is Reached.
+        DirectProbe *Probe `json:"direct_probe,omitempty"`
+
+        // Loop is the routing loop at which the trace stopped, if
+        // Options.DetectLoops is set, or nil if there was none
+        Loop *RoutingLoop `json:"loop,omitempty"`
+
+        // LastResponsiveTTL is the TTL of the last hop, which responded
+        // to any of its probes, or zero if none of the hops responded
+        LastResponsiveTTL int `json:"last_responsive_ttl"`
+
+        // FirstDarkTTL is the TTL at which the path goes dark, i.e. the
+        // first of the hops up to the last one probed, which did not
+        // respond to any of their probes, e.g. because a firewall
+        // drops everything beyond. It is -1 if the destination was
+        // reached, or the last hop responded.
+        FirstDarkTTL int `json:"first_dark_ttl"`
+}
+
+// NewResult creates a new Result from the probes of a trace to the
+// given destination. Probes which represent an error of the trace
+// itself, i.e. probes without a TTL, are ignored, and so are the hops
+// beyond the one at which the destination was reached.
+func NewResult(dest net.IP, probes []Probe) *Result {
+        b := newResultBuilder(dest, 0, 1)
+        for _, p := range probes {
+                b.add(p)
+        }
+
+        return b.build()
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface,
+// so that a completed trace can be stored and restored later.
+func (r *Result) MarshalBinary() ([]byte, error) {
+        return json.Marshal(r)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler
+// interface.
+func (r *Result) UnmarshalBinary(data []byte) error {
+        return json.Unmarshal(data, r)
+}
+
+// TraceAll traces the hops between us and the destination and
+// returns the result, once the trace has completed. If the context is
+// done before the destination has been reached, the partial result
+// with the hops probed so far is returned, along with an error
+// wrapping the error of the context. Since the trace only stops in
+// between hops, each of the returned hops is complete. When
+// Options.SuppressStars is set, the probes without a response are not
+// retained in Hop.Probes, but still counted in Hop.Stats.
+func (t *Tracer) TraceAll(ctx context.Context, dest net.IP) (*Result, error) {
+        var direct *Probe
+        if t.opts.ProbeDestinationDirectly {
+                probe, err := t.probeDirectly(ctx, dest)
+                if err != nil {
+                        return nil, err
+                }
+                direct = &probe
+        }
+
+        b := newResultBuilder(dest, t.opts.MaxRetainedProbes, t.opts.ConfirmThreshold)
+
+        // The probes without a response are still needed for the
+        // loss statistics, even if they are not to be retained
+        tracer := t
+        if t.opts.SuppressStars {
+                b.dropStars = true
+                tracer = t.clone(func(opts *Options) {
+                        opts.SuppressStars = false
+                })
+        }
+
+        var loops *loopDetector
+        if t.opts.DetectLoops {
+                loops = newLoopDetector(t.opts.LoopThreshold)
+        }
+
+        for probe := range tracer.Trace(ctx, dest) {
+                if probe.Error != nil && probe.TTL == 0 {
+                        return nil, probe.Error
+                }
+                if loops != nil {
+                        loops.add(probe)
+                }
+                b.add(probe)
+        }
+
+        result := b.build()
+        result.DirectProbe = direct
+        if loops != nil {
+                result.Loop = loops.detected()
+        }
+        result.Method = traceMethod
+        result.Privileged = os.Geteuid() == 0
+        if t.opts.IncrementalRTT {
+                result.computeIncrementalRTT()
+        }
+        if err := ctx.Err(); err != nil && !result.Reached {
+                return result, fmt.Errorf("trace interrupted: %w", err)
+        }
+
+        return result, nil
+}
+
+// Sends a single probe with Options.DirectProbeTTL to the destination.
+func (t *Tracer) probeDirectly(ctx context.Context, dest net.IP) (Probe, error) {
+        ttl := t.opts.DirectProbeTTL
+        if ttl == 0 {
+                ttl = defaultDirectProbeTTL
+        }
+        direct := t.clone(func(opts *Options) {
+                opts.NumProbes = 1
+                opts.AdaptiveProbes = false
+                opts.SuppressStars = false
+                opts.EmitFirstResponse = false
+                opts.FailFast = false
+                opts.WarmupFirstHop = false
+                opts.OnHopDiscovered = nil
+        })
+
+        var probe Probe
+        for p := range direct.TraceTTLs(ctx, dest, []int{ttl}) {
+                if p.Error != nil && p.TTL == 0 {
+                        return Probe{}, p.Error
+                }
+                probe = p
+        }
+
+        return probe, nil
+}
+
+// Computes the incremental RTT of each responding hop relative to its
+// closest responding predecessor.
+func (r *Result) computeIncrementalRTT() {
+        var prev time.Duration
+        for i := range r.Hops {
+                hop := &r.Hops[i]
+                if hop.Stats.Received == 0 {
+                        continue
+                }
+
+                delta := hop.Stats.Avg - prev
+                if delta < 0 {
+                        delta = 0
+                        hop.RTTAnomaly = true
+                }
+                hop.IncrementalRTT = delta
+                prev = hop.Stats.Avg
+        }
+}
+
+// Computes the TTLs at which the path stops responding.
+func (r *Result) computeDarkness() {
+        r.LastResponsiveTTL = 0
+        r.FirstDarkTTL = -1
+        for _, hop := range r.Hops {
+                if hop.Stats.Received > 0 {
+                        r.LastResponsiveTTL = hop.TTL
+                        r.FirstDarkTTL = -1
+                        continue
+                }
+                if r.FirstDarkTTL == -1 {
+                        r.FirstDarkTTL = hop.TTL
+                }
+        }
+        if r.Reached {
+                r.FirstDarkTTL = -1
+        }
+}
+
+// MaxLatencyHop returns the hop which adds the most latency over its
+// closest responding predecessor, i.e. the likely bottleneck of the
+// path, along with the added latency. Hops which did not respond are
+// skipped, so the latency behind a lost hop is attributed to the next
+// responding one. It returns a zero Hop, if none of the hops responded.
+func (r *Result) MaxLatencyHop() (Hop, time.Duration) {
+        var maxHop Hop
+        var maxDelta, prev time.Duration
+        found := false
+        for _, hop := range r.Hops {
+                if hop.Stats.Received == 0 {
+                        continue
+                }
+
+                delta := hop.Stats.Avg - prev
+                if !found || delta > maxDelta {
+                        maxHop = hop
+                        maxDelta = delta
+                        found = true
+                }
+                prev = hop.Stats.Avg
+        }
+
+        return maxHop, maxDelta
+}
+
+// AllAddrs returns the distinct addresses of all hops, which responded
+// to any of the probes, ordered by the TTL at which they first
+// responded.
+func (r *Result) AllAddrs() []net.IP {
+        seen := make(map[string]bool)
+        addrs := make([]net.IP, 0)
+        for _, hop := range r.Hops {
+                for _, addr := range hopAddrs(hop) {
+                        if seen[addr.String()] {
+                                continue
+                        }
+                        seen[addr.String()] = true
+                        addrs = append(addrs, addr)
+                }
+        }
+
+        return addrs
+}
+
+// StarKey is the key of ByTTLAndAddress, under which the probes of a
+// hop without a response are counted.
+const StarKey = "*"
+
+// ByTTLAndAddress returns the statistics of the hops keyed by TTL, and
+// then by the string form of each responding address, e.g. for use in
+// templates. The probes of a hop which did not receive a response are
+// counted under StarKey, so a hop without any response only has that
+// key. The statistics of an address are taken from Hop.Addresses,
+// which does not track the loss nor the standard deviation per
+// address, so its Sent equals Received, and both Loss and StdDev are
+// zero.
+func (r *Result) ByTTLAndAddress() map[int]map[string]*HopStats {
+        byTTL := make(map[int]map[string]*HopStats, len(r.Hops))
+        for _, hop := range r.Hops {
+                byAddr := make(map[string]*HopStats, len(hop.Addresses)+1)
+                for _, addr := range hop.Addresses {
+                        byAddr[addr.Addr.String()] = &HopStats{
+                                Sent:     addr.Received,
+                                Received: addr.Received,
+                                Min:      addr.Min,
+                                Max:      addr.Max,
+                                Avg:      addr.Avg,
+                        }
+                }
+                if lost := hop.Stats.Sent - hop.Stats.Received; lost > 0 {
+                        byAddr[StarKey] = &HopStats{
+                                Sent: lost,
+                                Loss: 100,
+                        }
+                }
+                byTTL[hop.TTL] = byAddr
+        }
+
+        return byTTL
+}
+
+// Creates a new hop from the probes sent with the given TTL
+func newHop(ttl int, probes []Probe) Hop {
+        b := newHopBuilder(ttl)
+        for _, p := range probes {
+                b.add(p, 0)
+        }
+
+        return b.build(1)
+}
+
+// Builds a Result from the probes of a trace, as they arrive
+type resultBuilder struct {
+        result *Result
+        hops   map[int]*hopBuilder
+
+        // Maximum number of probes to retain per hop, zero means all
+        retain int
+
+        // Number of responses from the same address confirming a hop
+        threshold int
+
+        // Whether to only count the probes without a response
+        dropStars bool
+}
+
+// Creates a new builder of a Result
+func newResultBuilder(dest net.IP, retain, threshold int) *resultBuilder {
+        b := &resultBuilder{
+                result: &Result{
+                        Destination: dest,
+                        Hops:        make([]Hop, 0),
+                },
+                hops:      make(map[int]*hopBuilder),
+                retain:    retain,
+                threshold: threshold,
+        }
+
+        return b
+}
+
+// Adds a probe to the result
+func (b *resultBuilder) add(p Probe) {
+        if p.TTL == 0 {
+                return
+        }
+
+        if b.result.Start.IsZero() || p.Start.Before(b.result.Start) {
+                b.result.Start = p.Start
+        }
+        if p.End.After(b.result.End) {
+                b.result.End = p.End
+        }
+        if p.Reached {
+                b.result.Reached = true
+        }
+
+        hb, ok := b.hops[p.TTL]
+        if !ok {
+                hb = newHopBuilder(p.TTL)
+                b.hops[p.TTL] = hb
+        }
+        if b.dropStars && !p.Responded() {
+                hb.count(p)
+                return
+        }
+        hb.add(p, b.retain)
+}
+
+// Returns the result with the hops ordered by TTL
+func (b *resultBuilder) build() *Result {
+        result := b.result
+        for _, hb := range b.hops {
+                result.Hops = append(result.Hops, hb.build(b.threshold))
+        }
+
+        sort.Slice(result.Hops, func(i, j int) bool {
+                return result.Hops[i].TTL < result.Hops[j].TTL
+        })
+
+        // Hops beyond the destination are only probed, when the TTLs
+        // are probed in random order
+        for i, hop := range result.Hops {
+                if b.hops[hop.TTL].reached {
+                        stats := hop.Stats
+                        result.DestinationRTT = &stats
+                        result.Hops = result.Hops[:i+1]
+                        break
+                }
+        }
+        result.computeDarkness()
+
+        return result
+}
+
+// Accumulates the statistics of a hop, without having to retain all of
+// its probes
+type hopBuilder struct {
+        hop Hop
+
+        // Index of each address in Hop.Addresses, and the sum of the
+        // RTTs of its responses
+        index map[string]int
+        sums  []time.Duration
+
+        // Running mean and sum of squared differences of the RTT
+        mean, m2 float64
+
+        // Whether the destination responded at this hop
+        reached bool
+}
+
+// Creates a new builder of a Hop
+func newHopBuilder(ttl int) *hopBuilder {
+        b := &hopBuilder{
+                hop: Hop{
+                        TTL:    ttl,
+                        Probes: make([]Probe, 0),
+                },
+                index: make(map[string]int),
+        }
+
+        return b
+}
+
+// Adds a probe to the hop, retaining at most retain probes, or all of
+// them if retain is zero
+func (b *hopBuilder) add(p Probe, retain int) {
+        if retain <= 0 || len(b.hop.Probes) < retain {
+                b.hop.Probes = append(b.hop.Probes, p)
+        }
+        b.count(p)
+}
+
+// Accounts for the probe in the statistics of the hop, without
+// retaining it
+func (b *hopBuilder) count(p Probe) {
+        stats := &b.hop.Stats
+        stats.Sent++
+        if p.Reached {
+                b.reached = true
+        }
+        if !p.Responded() {
+                return
+        }
+
+        if b.hop.Addr == nil {
+                b.hop.Addr = p.Hop
+                b.hop.Name = p.Name
+                b.hop.ReplyTTL = p.ReplyTTL
+        }
+        rtt := p.RTT()
+        i, ok := b.index[p.Hop.String()]
+        if !ok {
+                i = len(b.hop.Addresses)
+                b.index[p.Hop.String()] = i
+                b.hop.Addresses = append(b.hop.Addresses, AddrStats{Addr: p.Hop, Min: rtt})
+                b.sums = append(b.sums, 0)
+        }
+        addr := &b.hop.Addresses[i]
+        addr.Received++
+        b.sums[i] += rtt
+        if rtt < addr.Min {
+                addr.Min = rtt
+        }
+        if rtt > addr.Max {
+                addr.Max = rtt
+        }
+
+        if stats.Received == 0 || rtt < stats.Min {
+                stats.Min = rtt
+        }
+        if rtt > stats.Max {
+                stats.Max = rtt
+        }
+        stats.Received++
+
+        // Welford's online algorithm
+        delta := float64(rtt) - b.mean
+        b.mean += delta / float64(stats.Received)
+        b.m2 += delta * (float64(rtt) - b.mean)
+}
+
+// Returns the hop, which is confirmed if at least threshold probes
+// received a response from the same address
+func (b *hopBuilder) build(threshold int) Hop {
+        hop := b.hop
+        stats := &hop.Stats
+        if stats.Sent > 0 {
+                stats.Loss = float64(stats.Sent-stats.Received) / float64(stats.Sent) * 100
+                hop.ResponseRatio = float64(stats.Received) / float64(stats.Sent)
+        }
+        if stats.Received > 0 {
+                stats.Avg = time.Duration(b.mean)
+                stats.StdDev = time.Duration(math.Sqrt(b.m2 / float64(stats.Received)))
+        }
+
+        hop.ProbableRateLimit, hop.EstimatedRate = detectRateLimit(hop)
+
+        if threshold < 1 {
+                threshold = 1
+        }
+        hop.Addresses = make([]AddrStats, len(b.hop.Addresses))
+        for i, addr := range b.hop.Addresses {
+                addr.Avg = b.sums[i] / time.Duration(addr.Received)
+                hop.Addresses[i] = addr
+                if addr.Received >= threshold {
+                        hop.Confirmed = true
+                }
+        }
+        hop.Diverged = len(hop.Addresses) > 1
+
+        return hop
+}
+
+// Minimum number of replies and maximum coefficient of variation of
+// their intervals, for detecting a rate limited hop
+const (
+        rateLimitMinReplies   = 3
+        rateLimitMaxVariation = 0.1
+)
+
+// Returns whether the replies of a hop with partial loss are spaced
+// regularly, and the rate of the replies per second if so
+func detectRateLimit(hop Hop) (bool, float64) {
+        if hop.Stats.Received == hop.Stats.Sent {
+                return false, 0
+        }
+
+        ends := make([]time.Time, 0, len(hop.Probes))
+        for _, p := range hop.Probes {
+                if p.Responded() {
+                        ends = append(ends, p.End)
+                }
+        }
+        if len(ends) < rateLimitMinReplies {
+                return false, 0
+        }
+        sort.Slice(ends, func(i, j int) bool {
+                return ends[i].Before(ends[j])
+        })
+
+        intervals := make([]float64, 0, len(ends)-1)
+        var sum float64
+        for i := 1; i < len(ends); i++ {
+                interval := float64(ends[i].Sub(ends[i-1]))
+                intervals = append(intervals, interval)
+                sum += interval
+        }
+        mean := sum / float64(len(intervals))
+        if mean <= 0 {
+                return false, 0
+        }
+
+        var variance float64
+        for _, interval := range intervals {
+                variance += (interval - mean) * (interval - mean)
+        }
+        variance /= float64(len(intervals))
+        if math.Sqrt(variance)/mean >= rateLimitMaxVariation {
+                return false, 0
+        }
+
+        return true, float64(time.Second) / mean
+}
@@ -0,0 +1,383 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "math"
+        "net"
+        "testing"
+        "time"
+)
+
+func TestResultBuilderDropStars(t *testing.T) {
+        hop := net.IPv4(192, 0, 2, 1)
+        probes := []Probe{
+                {TTL: 1, Hop: hop},
+                {TTL: 1, Hop: net.IPv4zero},
+                {TTL: 1, Hop: hop},
+                {TTL: 2, Hop: net.IPv4zero},
+        }
+
+        tests := []struct {
+                name     string
+                drop     bool
+                retained []int
+        }{
+                {"retained", false, []int{3, 1}},
+                {"dropped", true, []int{2, 0}},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        b := newResultBuilder(net.IPv4(198, 51, 100, 1), 0, 1)
+                        b.dropStars = tc.drop
+                        for _, p := range probes {
+                                b.add(p)
+                        }
+                        r := b.build()
+
+                        if len(r.Hops) != 2 {
+                                t.Fatalf("got %d hops, want 2", len(r.Hops))
+                        }
+                        for i, hop := range r.Hops {
+                                if len(hop.Probes) != tc.retained[i] {
+                                        t.Errorf("hop %d retained %d probes, want %d", hop.TTL, len(hop.Probes), tc.retained[i])
+                                }
+                        }
+                        if s := r.Hops[0].Stats; s.Sent != 3 || s.Received != 2 {
+                                t.Errorf("hop 1 has %d of %d probes received, want 2 of 3", s.Received, s.Sent)
+                        }
+                        if ratio := r.Hops[0].ResponseRatio; math.Abs(ratio-2.0/3) > 1e-9 {
+                                t.Errorf("hop 1 has a response ratio of %v, want 2/3", ratio)
+                        }
+                        if s := r.Hops[1].Stats; s.Sent != 1 || s.Loss != 100 {
+                                t.Errorf("hop 2 has %d probes sent with %.0f%% loss, want 1 with 100%%", s.Sent, s.Loss)
+                        }
+                })
+        }
+}
+
+func TestPartialResponders(t *testing.T) {
+        start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+        hop := net.IPv4(192, 0, 2, 1)
+
+        // Sends a probe every 10ms, of which the ones at the given
+        // indices receive a reply after 1ms
+        probes := func(n int, replies ...int) []Probe {
+                ps := make([]Probe, n)
+                for i := range ps {
+                        sent := start.Add(time.Duration(i) * 10 * time.Millisecond)
+                        ps[i] = Probe{TTL: 1, Hop: net.IPv4zero, Start: sent, End: sent.Add(time.Second)}
+                }
+                for _, i := range replies {
+                        ps[i].Hop = hop
+                        ps[i].End = ps[i].Start.Add(time.Millisecond)
+                }
+                return ps
+        }
+
+        tests := []struct {
+                name    string
+                probes  []Probe
+                loss    float64
+                ratio   float64
+                limited bool
+                rate    float64
+        }{
+                {"every third reply", probes(9, 0, 3, 6), 200.0 / 3, 1.0 / 3, true, 1000.0 / 30},
+                {"every other reply", probes(10, 0, 2, 4, 6, 8), 50, 0.5, true, 50},
+                {"irregular replies", probes(9, 0, 1, 5, 6), 500.0 / 9, 4.0 / 9, false, 0},
+                {"too few replies", probes(9, 0, 4), 700.0 / 9, 2.0 / 9, false, 0},
+                {"no loss", probes(3, 0, 1, 2), 0, 1, false, 0},
+                {"no replies", probes(3), 100, 0, false, 0},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        result := NewResult(net.IPv4(198, 51, 100, 1), tc.probes)
+                        if len(result.Hops) != 1 {
+                                t.Fatalf("got %d hops, want 1", len(result.Hops))
+                        }
+                        h := result.Hops[0]
+
+                        if math.Abs(h.Stats.Loss-tc.loss) > 1e-9 {
+                                t.Errorf("got %v%% loss, want %v%%", h.Stats.Loss, tc.loss)
+                        }
+                        if math.Abs(h.ResponseRatio-tc.ratio) > 1e-9 {
+                                t.Errorf("got a response ratio of %v, want %v", h.ResponseRatio, tc.ratio)
+                        }
+                        if h.ProbableRateLimit != tc.limited {
+                                t.Errorf("got ProbableRateLimit %v, want %v", h.ProbableRateLimit, tc.limited)
+                        }
+                        if math.Abs(h.EstimatedRate-tc.rate) > 1e-6 {
+                                t.Errorf("got an estimated rate of %v/s, want %v/s", h.EstimatedRate, tc.rate)
+                        }
+                })
+        }
+}
+
+func TestDestinationRTT(t *testing.T) {
+        start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+        dest := net.IPv4(198, 51, 100, 1)
+        probe := func(ttl int, hop net.IP, rtt time.Duration) Probe {
+                return Probe{TTL: ttl, Hop: hop, Start: start, End: start.Add(rtt), Reached: hop.Equal(dest)}
+        }
+        hop := net.IPv4(192, 0, 2, 1)
+
+        tests := []struct {
+                name   string
+                probes []Probe
+                hops   int
+                want   *HopStats
+        }{
+                {
+                        name: "reached",
+                        probes: []Probe{
+                                probe(1, hop, time.Millisecond),
+                                probe(2, dest, 10*time.Millisecond),
+                                probe(2, dest, 20*time.Millisecond),
+                                probe(2, net.IPv4zero, 0),
+                        },
+                        hops: 2,
+                        want: &HopStats{Sent: 3, Received: 2, Loss: 100.0 / 3, Min: 10 * time.Millisecond, Max: 20 * time.Millisecond, Avg: 15 * time.Millisecond},
+                },
+                {
+                        name: "not reached",
+                        probes: []Probe{
+                                probe(1, hop, time.Millisecond),
+                                probe(2, net.IPv4zero, 0),
+                        },
+                        hops: 2,
+                },
+                {
+                        name: "hops beyond the destination",
+                        probes: []Probe{
+                                probe(3, dest, 5*time.Millisecond),
+                                probe(1, hop, time.Millisecond),
+                                probe(2, dest, 4*time.Millisecond),
+                        },
+                        hops: 2,
+                        want: &HopStats{Sent: 1, Received: 1, Min: 4 * time.Millisecond, Max: 4 * time.Millisecond, Avg: 4 * time.Millisecond},
+                },
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        r := NewResult(dest, tc.probes)
+                        if len(r.Hops) != tc.hops {
+                                t.Errorf("got %d hops, want %d", len(r.Hops), tc.hops)
+                        }
+                        if tc.want == nil {
+                                if r.DestinationRTT != nil {
+                                        t.Errorf("got DestinationRTT %+v, want nil", *r.DestinationRTT)
+                                }
+                                return
+                        }
+                        got := r.DestinationRTT
+                        if got == nil {
+                                t.Fatal("got no DestinationRTT")
+                        }
+                        if got.Sent != tc.want.Sent || got.Received != tc.want.Received || math.Abs(got.Loss-tc.want.Loss) > 1e-9 {
+                                t.Errorf("got %d of %d received with %v%% loss, want %d of %d with %v%%",
+                                        got.Received, got.Sent, got.Loss, tc.want.Received, tc.want.Sent, tc.want.Loss)
+                        }
+                        if got.Min != tc.want.Min || got.Max != tc.want.Max || got.Avg != tc.want.Avg {
+                                t.Errorf("got min/avg/max %v/%v/%v, want %v/%v/%v",
+                                        got.Min, got.Avg, got.Max, tc.want.Min, tc.want.Avg, tc.want.Max)
+                        }
+                })
+        }
+}
+
+func TestConfirmThreshold(t *testing.T) {
+        a, b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+        probes := func(hops ...net.IP) []Probe {
+                ps := make([]Probe, len(hops))
+                for i, hop := range hops {
+                        ps[i] = Probe{TTL: 1, Hop: hop}
+                }
+                return ps
+        }
+
+        tests := []struct {
+                name      string
+                probes    []Probe
+                threshold int
+                want      bool
+        }{
+                {"any response without threshold", probes(a, net.IPv4zero, net.IPv4zero), 0, true},
+                {"single address at threshold", probes(a, a, net.IPv4zero), 2, true},
+                {"single address below threshold", probes(a, net.IPv4zero, net.IPv4zero), 2, false},
+                {"mixed addresses below threshold", probes(a, b, net.IPv4zero), 2, false},
+                {"mixed addresses, one at threshold", probes(a, b, a), 2, true},
+                {"mixed addresses only in sum", probes(a, b, a, b), 3, false},
+                {"no responses", probes(net.IPv4zero, net.IPv4zero), 1, false},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        rb := newResultBuilder(net.IPv4(198, 51, 100, 1), 0, tc.threshold)
+                        for _, p := range tc.probes {
+                                rb.add(p)
+                        }
+                        r := rb.build()
+                        if len(r.Hops) != 1 {
+                                t.Fatalf("got %d hops, want 1", len(r.Hops))
+                        }
+                        if got := r.Hops[0].Confirmed; got != tc.want {
+                                t.Errorf("got Confirmed %v, want %v", got, tc.want)
+                        }
+                })
+        }
+}
+
+// Returns a result with a hop per given average RTT, starting with TTL
+// 1, where a negative RTT represents a hop without a response
+func resultWithAvgs(avgs ...time.Duration) *Result {
+        r := &Result{Destination: net.IPv4(198, 51, 100, 1)}
+        for i, avg := range avgs {
+                hop := Hop{TTL: i + 1, Stats: HopStats{Sent: 1, Loss: 100}}
+                if avg >= 0 {
+                        hop.Addr = net.IPv4(192, 0, 2, byte(i+1))
+                        hop.Stats = HopStats{Sent: 1, Received: 1, Min: avg, Max: avg, Avg: avg}
+                }
+                r.Hops = append(r.Hops, hop)
+        }
+
+        return r
+}
+
+func TestMaxLatencyHop(t *testing.T) {
+        ms := time.Millisecond
+        tests := []struct {
+                name  string
+                avgs  []time.Duration
+                ttl   int
+                delta time.Duration
+        }{
+                {"rising", []time.Duration{1 * ms, 2 * ms, 3 * ms}, 1, 1 * ms},
+                {"bottleneck", []time.Duration{1 * ms, 2 * ms, 40 * ms, 41 * ms}, 3, 38 * ms},
+                {"behind a lost hop", []time.Duration{1 * ms, -1, 30 * ms, 31 * ms}, 3, 29 * ms},
+                {"first hop", []time.Duration{20 * ms, 5 * ms, 10 * ms}, 1, 20 * ms},
+                {"falling", []time.Duration{-1, 10 * ms, 8 * ms}, 2, 10 * ms},
+                {"no responses", []time.Duration{-1, -1}, 0, 0},
+                {"no hops", nil, 0, 0},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        hop, delta := resultWithAvgs(tc.avgs...).MaxLatencyHop()
+                        if hop.TTL != tc.ttl || delta != tc.delta {
+                                t.Errorf("got hop %d adding %v, want hop %d adding %v", hop.TTL, delta, tc.ttl, tc.delta)
+                        }
+                })
+        }
+}
+
+func TestByTTLAndAddress(t *testing.T) {
+        ms := time.Millisecond
+        a, b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+        start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+        probe := func(ttl int, hop net.IP, rtt time.Duration) Probe {
+                return Probe{TTL: ttl, Hop: hop, Start: start, End: start.Add(rtt)}
+        }
+        r := NewResult(net.IPv4(198, 51, 100, 1), []Probe{
+                probe(1, a, 2*ms),
+                probe(1, a, 4*ms),
+                probe(1, a, 6*ms),
+                probe(2, a, 10*ms),
+                probe(2, b, 20*ms),
+                probe(2, net.IPv4zero, time.Second),
+                probe(3, net.IPv4zero, time.Second),
+                probe(3, net.IPv4zero, time.Second),
+        })
+
+        want := map[int]map[string]HopStats{
+                1: {
+                        "192.0.2.1": {Sent: 3, Received: 3, Min: 2 * ms, Max: 6 * ms, Avg: 4 * ms},
+                },
+                2: {
+                        "192.0.2.1": {Sent: 1, Received: 1, Min: 10 * ms, Max: 10 * ms, Avg: 10 * ms},
+                        "192.0.2.2": {Sent: 1, Received: 1, Min: 20 * ms, Max: 20 * ms, Avg: 20 * ms},
+                        StarKey:     {Sent: 1, Loss: 100},
+                },
+                3: {
+                        StarKey: {Sent: 2, Loss: 100},
+                },
+        }
+
+        got := r.ByTTLAndAddress()
+        if len(got) != len(want) {
+                t.Fatalf("got %d TTLs, want %d", len(got), len(want))
+        }
+        for ttl, addrs := range want {
+                if len(got[ttl]) != len(addrs) {
+                        t.Errorf("got %d keys for TTL %d, want %d", len(got[ttl]), ttl, len(addrs))
+                }
+                for key, stats := range addrs {
+                        s, ok := got[ttl][key]
+                        if !ok {
+                                t.Errorf("got no key %q for TTL %d", key, ttl)
+                                continue
+                        }
+                        if *s != stats {
+                                t.Errorf("got %+v for %q at TTL %d, want %+v", *s, key, ttl, stats)
+                        }
+                }
+        }
+}
+
+func TestComputeDarkness(t *testing.T) {
+        ms := time.Millisecond
+        tests := []struct {
+                name    string
+                avgs    []time.Duration
+                reached bool
+                last    int
+                dark    int
+        }{
+                {"all responsive", []time.Duration{ms, ms, ms}, false, 3, -1},
+                {"reached", []time.Duration{ms, -1, ms}, true, 3, -1},
+                {"dark from the start", []time.Duration{-1, -1}, false, 0, 1},
+                {"dark after a hop", []time.Duration{ms, ms, -1, -1}, false, 2, 3},
+                {"lost hop in between", []time.Duration{ms, -1, ms, -1, -1}, false, 3, 4},
+                {"single dark hop at the end", []time.Duration{ms, -1, ms, -1}, false, 3, 4},
+                {"responsive again at the end", []time.Duration{ms, -1, -1, ms}, false, 4, -1},
+                {"no hops", nil, false, 0, -1},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        r := resultWithAvgs(tc.avgs...)
+                        r.Reached = tc.reached
+                        r.computeDarkness()
+                        if r.LastResponsiveTTL != tc.last || r.FirstDarkTTL != tc.dark {
+                                t.Errorf("got LastResponsiveTTL %d and FirstDarkTTL %d, want %d and %d",
+                                        r.LastResponsiveTTL, r.FirstDarkTTL, tc.last, tc.dark)
+                        }
+                })
+        }
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "net"
+        "time"
+)
+
+// TraceSample represents a single probe of a trace as a flat record,
+// e.g. for bulk inserting into a time-series database.
+type TraceSample struct {
+        // Timestamp is the time at which the probe was sent
+        Timestamp time.Time `json:"timestamp"`
+
+        // Destination of the trace
+        Destination net.IP `json:"destination"`
+
+        // TTL of the probe
+        TTL int `json:"ttl"`
+
+        // ProbeIndex is the index of the probe within its hop
+        ProbeIndex int `json:"probe_index"`
+
+        // Hop is the address of the responding hop, or nil if the
+        // probe did not receive a response
+        Hop net.IP `json:"hop"`
+
+        // RTT of the probe, or zero if it did not receive a response
+        RTT time.Duration `json:"rtt"`
+
+        // Reached is true, if the probe was answered by the destination
+        Reached bool `json:"reached"`
+}
+
+// Samples flattens the result into one sample per retained probe,
+// ordered by TTL and probe index.
+func (r *Result) Samples() []TraceSample {
+        count := 0
+        for _, hop := range r.Hops {
+                count += len(hop.Probes)
+        }
+
+        samples := make([]TraceSample, 0, count)
+        for _, hop := range r.Hops {
+                for i, p := range hop.Probes {
+                        sample := TraceSample{
+                                Timestamp:   p.Start,
+                                Destination: r.Destination,
+                                TTL:         hop.TTL,
+                                ProbeIndex:  i,
+                                Reached:     p.Reached,
+                        }
+                        if p.Responded() {
+                                sample.Hop = p.Hop
+                                sample.RTT = p.RTT()
+                        }
+                        samples = append(samples, sample)
+                }
+        }
+
+        return samples
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "net"
+        "testing"
+)
+
+func TestSamples(t *testing.T) {
+        dest := net.IPv4(198, 51, 100, 1)
+        gw := net.IPv4(192, 0, 2, 1)
+
+        tests := []struct {
+                name   string
+                probes []Probe
+                hops   int
+                per    int
+        }{
+                {"no hops", nil, 0, 0},
+                {"one probe per hop", traceProbes(dest, gw, nil, dest), 3, 1},
+                {"three probes per hop", append(append(traceProbes(dest, gw, nil, dest),
+                        traceProbes(dest, gw, nil, dest)...), traceProbes(dest, nil, nil, dest)...), 3, 3},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        r := NewResult(dest, tc.probes)
+                        samples := r.Samples()
+                        if len(samples) != tc.hops*tc.per {
+                                t.Fatalf("got %d samples, want %d hops × %d probes", len(samples), tc.hops, tc.per)
+                        }
+
+                        for i, s := range samples {
+                                hop := r.Hops[i/tc.per]
+                                p := hop.Probes[i%tc.per]
+                                if s.TTL != hop.TTL || s.ProbeIndex != i%tc.per {
+                                        t.Errorf("sample %d is probe %d of TTL %d, want probe %d of TTL %d", i, s.ProbeIndex, s.TTL, i%tc.per, hop.TTL)
+                                }
+                                if !s.Destination.Equal(dest) || !s.Timestamp.Equal(p.Start) || s.Reached != p.Reached {
+                                        t.Errorf("sample %d = %+v does not match probe %+v", i, s, p)
+                                }
+                                if p.Responded() {
+                                        if !s.Hop.Equal(p.Hop) || s.RTT != p.RTT() {
+                                                t.Errorf("sample %d has hop %v with RTT %v, want %v with %v", i, s.Hop, s.RTT, p.Hop, p.RTT())
+                                        }
+                                } else if s.Hop != nil || s.RTT != 0 {
+                                        t.Errorf("sample %d of a lost probe has hop %v with RTT %v", i, s.Hop, s.RTT)
+                                }
+                        }
+                })
+        }
+}
+
+func TestSamplesRetained(t *testing.T) {
+        dest := net.IPv4(198, 51, 100, 1)
+        b := newResultBuilder(dest, 1, 1)
+        for _, p := range append(traceProbes(dest, dest), traceProbes(dest, dest)...) {
+                b.add(p)
+        }
+        if got := len(b.build().Samples()); got != 1 {
+                t.Errorf("got %d samples, want one per retained probe", got)
+        }
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "errors"
+        "sync"
+)
+
+// ErrShutdown is the error of the traces started after the Tracer has
+// been shut down via Shutdown.
+var ErrShutdown = errors.New("tracer is shut down")
+
+// Shutdown cancels all in-flight traces of the Tracer, including the
+// ones of TraceMany, TraceAll and Monitor, and waits until their
+// goroutines have exited and their sockets have been closed, or the
+// context is done, in which case the error of the context is
+// returned. Since a trace only stops in between hops, this may take up
+// to the duration of a hop. The consumers have to keep draining the
+// channels of the traces, which are closed once they are done. Traces
+// started after Shutdown fail with ErrShutdown. The managed socket of
+// Open is not affected, and has to be released via Close.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+        return t.ops.shutdown(ctx)
+}
+
+// Registers an in-flight operation, which Shutdown cancels and waits
+// for. It returns the context of the operation, and the function to
+// call once the operation is done. It fails with ErrShutdown, if the
+// Tracer has been shut down.
+func (t *Tracer) track(ctx context.Context) (context.Context, func(), error) {
+        return t.ops.track(ctx)
+}
+
+// Tracks the in-flight operations of a Tracer and its clones
+type operations struct {
+        mu      sync.Mutex
+        cancels map[int]context.CancelFunc
+        seq     int
+        wg      sync.WaitGroup
+        closed  bool
+}
+
+// Creates a new set of operations
+func newOperations() *operations {
+        return &operations{
+                cancels: make(map[int]context.CancelFunc),
+        }
+}
+
+// Registers an operation with the given context, see Tracer.track.
+func (o *operations) track(ctx context.Context) (context.Context, func(), error) {
+        o.mu.Lock()
+        defer o.mu.Unlock()
+
+        if o.closed {
+                return nil, nil, ErrShutdown
+        }
+
+        ctx, cancel := context.WithCancel(ctx)
+        id := o.seq
+        o.seq++
+        o.cancels[id] = cancel
+        o.wg.Add(1)
+
+        untrack := func() {
+                o.mu.Lock()
+                delete(o.cancels, id)
+                o.mu.Unlock()
+
+                cancel()
+                o.wg.Done()
+        }
+
+        return ctx, untrack, nil
+}
+
+// Cancels all operations and waits for them, see Tracer.Shutdown.
+func (o *operations) shutdown(ctx context.Context) error {
+        o.mu.Lock()
+        o.closed = true
+        for _, cancel := range o.cancels {
+                cancel()
+        }
+        o.mu.Unlock()
+
+        done := make(chan struct{})
+        go func() {
+                o.wg.Wait()
+                close(done)
+        }()
+
+        select {
+        case <-done:
+                return nil
+        case <-ctx.Done():
+                return ctx.Err()
+        }
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "errors"
+        "net"
+        "testing"
+        "time"
+)
+
+func TestShutdownCoversClones(t *testing.T) {
+        tracer := New(&Options{})
+        clone := tracer.clone(func(opts *Options) {})
+
+        ctx, untrack, err := clone.track(context.Background())
+        if err != nil {
+                t.Fatalf("track: %v", err)
+        }
+
+        done := make(chan error)
+        go func() {
+                done <- tracer.Shutdown(context.Background())
+        }()
+
+        select {
+        case <-ctx.Done():
+        case <-time.After(time.Second):
+                t.Fatal("operation of the clone was not cancelled")
+        }
+        select {
+        case err := <-done:
+                t.Fatalf("Shutdown returned %v before the operation was done", err)
+        case <-time.After(50 * time.Millisecond):
+        }
+
+        untrack()
+        if err := <-done; err != nil {
+                t.Fatalf("Shutdown: %v", err)
+        }
+        if _, _, err := clone.track(context.Background()); !errors.Is(err, ErrShutdown) {
+                t.Fatalf("got %v after Shutdown, want ErrShutdown", err)
+        }
+}
+
+func TestShutdownExpires(t *testing.T) {
+        tracer := New(&Options{})
+        _, untrack, err := tracer.track(context.Background())
+        if err != nil {
+                t.Fatalf("track: %v", err)
+        }
+        defer untrack()
+
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+        defer cancel()
+        if err := tracer.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+                t.Fatalf("got %v, want context.DeadlineExceeded", err)
+        }
+}
+
+func TestShutdownUnblocksConsumers(t *testing.T) {
+        // Every hop takes at least 20ms, so the full trace of the
+        // loopback address would take several seconds
+        opts := Options{
+                DestinationPort:      33434,
+                NumProbes:            1,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                ProbeSendOffsets:     []time.Duration{20 * time.Millisecond},
+        }
+        ttls := make([]int, 0, 200)
+        for ttl := 1; ttl <= 200; ttl++ {
+                ttls = append(ttls, ttl)
+        }
+
+        tracer := New(&opts)
+        clone := tracer.clone(func(opts *Options) {})
+        channels := []<-chan Probe{
+                tracer.TraceTTLs(context.Background(), net.IPv4(127, 0, 0, 1), ttls),
+                clone.TraceTTLs(context.Background(), net.IPv4(127, 0, 0, 1), ttls),
+        }
+
+        closed := make(chan struct{}, len(channels))
+        for _, ch := range channels {
+                go func(ch <-chan Probe) {
+                        for probe := range ch {
+                                if probe.Error != nil && probe.TTL == 0 {
+                                        t.Errorf("trace failed: %v", probe.Error)
+                                }
+                        }
+                        closed <- struct{}{}
+                }(ch)
+        }
+
+        time.Sleep(100 * time.Millisecond)
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        if err := tracer.Shutdown(ctx); err != nil {
+                t.Fatalf("Shutdown: %v", err)
+        }
+        for range channels {
+                select {
+                case <-closed:
+                case <-time.After(time.Second):
+                        t.Fatal("channel of a trace was not closed")
+                }
+        }
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "net"
+        "syscall"
+        "time"
+)
+
+// The socket used by SendProbe and PollReplies
+type managedSocket struct {
+        fd      int
+        epollFd int
+
+        // Probes awaiting a reply, keyed by their identifier
+        pending map[uint16]*pendingProbe
+}
+
+// A probe sent via SendProbe, which awaits a reply
+type pendingProbe struct {
+        probe   Probe
+        to      *syscall.SockaddrInet4
+        payload []byte
+}
+
+// Open sets up the managed socket for driving the probing via
+// SendProbe and PollReplies, instead of Trace. The socket is
+// configured according to the options of the Tracer, and must be
+// released via Close once done.
+func (t *Tracer) Open() error {
+        t.sockMu.Lock()
+        defer t.sockMu.Unlock()
+
+        if t.sock != nil {
+                return errors.New("socket is already open")
+        }
+
+        fd, epollFd, err := t.openSocket(1, 0)
+        if err != nil {
+                return err
+        }
+
+        t.sock = &managedSocket{
+                fd:      fd,
+                epollFd: epollFd,
+                pending: make(map[uint16]*pendingProbe),
+        }
+
+        return nil
+}
+
+// Close releases the managed socket set up via Open. Probes still
+// awaiting a reply are discarded.
+func (t *Tracer) Close() error {
+        t.sockMu.Lock()
+        defer t.sockMu.Unlock()
+
+        if t.sock == nil {
+                return ErrSocketNotOpen
+        }
+
+        syscall.Close(t.sock.epollFd)
+        err := syscall.Close(t.sock.fd)
+        t.sock = nil
+
+        return err
+}
+
+// SendProbe sends a single probe with the given TTL to the destination
+// over the managed socket, which must have been set up via Open. The
+// identifier distinguishes the replies to the probes awaiting one, and
+// must not be reused until the probe has been returned by PollReplies.
+// The built-in encoder stores it in the first two bytes of the
+// payload, which requires Options.PacketLength of at least 2. A custom
+// encoder receives it as the sequence number, and must produce
+// distinct payloads for distinct identifiers. The TTL is set via
+// IP_TTL right before the probe is sent, while holding the lock of the
+// managed socket, so it applies to exactly that probe, even when
+// probes are sent from multiple goroutines.
+func (t *Tracer) SendProbe(dest net.IP, ttl int, id uint16) error {
+        t.sockMu.Lock()
+        defer t.sockMu.Unlock()
+
+        if t.sock == nil {
+                return ErrSocketNotOpen
+        }
+        if _, ok := t.sock.pending[id]; ok {
+                return fmt.Errorf("probe %d is already pending", id)
+        }
+
+        b, err := t.encoder.Encode(ttl, int(id))
+        if err != nil {
+                return fmt.Errorf("unable to encode probe with TTL %d: %w", ttl, err)
+        }
+        if t.opts.Encoder == nil {
+                if len(b) < 2 {
+                        return errors.New("packet length too short for the probe identifier")
+                }
+                binary.BigEndian.PutUint16(b, id)
+        }
+
+        if err := syscall.SetsockoptInt(t.sock.fd, syscall.SOL_IP, syscall.IP_TTL, ttl); err != nil {
+                return fmt.Errorf("unable to set TTL %d: %w", ttl, err)
+        }
+
+        var dstAddr4 [4]byte
+        copy(dstAddr4[:], dest.To4())
+        to := &syscall.SockaddrInet4{
+                Port: int(t.opts.DestinationPort),
+                Addr: dstAddr4,
+        }
+
+        start := time.Now()
+        if err := sendTo(t.sock.fd, b, to); err != nil {
+                return sendError(ttl, err)
+        }
+
+        t.sock.pending[id] = &pendingProbe{
+                probe: Probe{
+                        Start:     start,
+                        Hop:       net.IPv4zero,
+                        TTL:       ttl,
+                        SentBytes: len(b),
+                        Port:      uint16(to.Port),
+                },
+                to:      to,
+                payload: b,
+        }
+
+        return nil
+}
+
+// PollReplies waits up to the given timeout for replies to the probes
+// sent via SendProbe, and returns the probes which have completed.
+// Probes without a reply are returned once Options.ProbeMaxWaitDuration
+// has passed since they were sent, with their Hop set to 0.0.0.0 just
+// like the probes of Trace. If reading the replies fails, the probes
+// completed so far are returned along with the error. PollReplies must
+// not be called concurrently with Close.
+func (t *Tracer) PollReplies(timeout time.Duration) ([]Probe, error) {
+        t.sockMu.Lock()
+        sock := t.sock
+        t.sockMu.Unlock()
+        if sock == nil {
+                return nil, ErrSocketNotOpen
+        }
+
+        events := make([]syscall.EpollEvent, 1)
+        if _, err := syscall.EpollWait(sock.epollFd, events, int(timeout.Milliseconds())); err != nil && err != syscall.EINTR {
+                return nil, fmt.Errorf("unable to wait for replies: %w", err)
+        }
+
+        t.sockMu.Lock()
+        defer t.sockMu.Unlock()
+
+        // https://datatracker.ietf.org/doc/html/rfc1812
+        p := make([]byte, 1500)
+        oob := make([]byte, 1500)
+        probes := make([]Probe, 0)
+        for {
+                reply, ok, err := readReply(sock.fd, p, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+                if errors.Is(err, syscall.EAGAIN) {
+                        break
+                }
+                if errors.Is(err, syscall.EINTR) {
+                        continue
+                }
+                if err != nil {
+                        return probes, fmt.Errorf("unable to read replies: %w", err)
+                }
+                if !ok || reply.quoted == nil {
+                        continue
+                }
+                for id, pending := range sock.pending {
+                        if reply.quoted.Addr != pending.to.Addr || !t.encoder.Match(pending.payload, reply.payload) {
+                                continue
+                        }
+                        probe := t.completeProbe(pending, time.Now())
+                        t.applyReply(&probe, reply, pending.to)
+                        t.checkRTT(&probe)
+                        probes = append(probes, probe)
+                        delete(sock.pending, id)
+                        break
+                }
+        }
+
+        now := time.Now()
+        for id, pending := range sock.pending {
+                if now.Sub(pending.probe.Start) < t.opts.ProbeMaxWaitDuration {
+                        continue
+                }
+                probes = append(probes, t.completeProbe(pending, now))
+                delete(sock.pending, id)
+        }
+
+        return probes, nil
+}
+
+// Returns the probe of the pending probe, which completed at the
+// given time.
+func (t *Tracer) completeProbe(pending *pendingProbe, end time.Time) Probe {
+        probe := pending.probe
+        probe.End = end
+        if t.opts.RandomizePayload || t.opts.UniquePayloadPerProbe || t.opts.Encoder != nil {
+                probe.Payload = pending.payload
+        }
+
+        return probe
+}
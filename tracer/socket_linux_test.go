@@ -0,0 +1,334 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "context"
+        "encoding/binary"
+        "errors"
+        "net"
+        "sync"
+        "syscall"
+        "testing"
+        "time"
+)
+
+// Returns a raw socket capturing the UDP datagrams on the loopback
+// interface, which is closed once the test completes. Skips the test,
+// if capturing requires privileges the test does not have.
+func openCapture(t *testing.T) int {
+        raw, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_UDP)
+        if err != nil {
+                t.Skipf("unable to capture probes: %v", err)
+        }
+        t.Cleanup(func() { syscall.Close(raw) })
+        timeout := syscall.NsecToTimeval(int64(time.Second))
+        if err := syscall.SetsockoptTimeval(raw, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+                t.Fatal(err)
+        }
+
+        return raw
+}
+
+// Returns the next captured IP packet, which carries a datagram to the
+// given port, and the length of its IP header.
+func capturePacket(t *testing.T, raw int, port uint16) ([]byte, int) {
+        b := make([]byte, 1500)
+        for {
+                n, _, err := syscall.Recvfrom(raw, b, 0)
+                if err != nil {
+                        t.Fatalf("no probe captured: %v", err)
+                }
+                ihl := int(b[0]&0x0f) * 4
+                if n >= ihl+8 && binary.BigEndian.Uint16(b[ihl+2:]) == port {
+                        return b[:n], ihl
+                }
+        }
+}
+
+// Address of a router on the loopback interface, which answers the
+// probes captured by routeProbes
+var loopbackRouter = net.IPv4(127, 0, 0, 2)
+
+// Answers the probes to the given port on the loopback interface from
+// the address, which answer returns for their TTL, as if the path to
+// the destination ran through the routers on the loopback interface.
+// A router answers with an ICMP time exceeded error, the destination
+// with a port unreachable error, and the probes for which answer
+// returns nil are not answered. The answers stop once the test
+// completes.
+func routeProbes(t *testing.T, port uint16, answer func(ttl int) net.IP) {
+        raw := openCapture(t)
+
+        // Raw sockets bound to the answering addresses
+        socks := make(map[string]int)
+        open := func(from net.IP) (int, error) {
+                if fd, ok := socks[from.String()]; ok {
+                        return fd, nil
+                }
+                fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+                if err != nil {
+                        return -1, err
+                }
+                addr := &syscall.SockaddrInet4{}
+                copy(addr.Addr[:], from.To4())
+                if err := syscall.Bind(fd, addr); err != nil {
+                        syscall.Close(fd)
+                        return -1, err
+                }
+                socks[from.String()] = fd
+                return fd, nil
+        }
+
+        done := make(chan struct{})
+        var wg sync.WaitGroup
+        wg.Add(1)
+        go func() {
+                defer wg.Done()
+                defer func() {
+                        for _, fd := range socks {
+                                syscall.Close(fd)
+                        }
+                }()
+                b := make([]byte, 1500)
+                for {
+                        n, _, err := syscall.Recvfrom(raw, b, 0)
+                        select {
+                        case <-done:
+                                return
+                        default:
+                        }
+                        if err != nil {
+                                continue
+                        }
+                        ihl := int(b[0]&0x0f) * 4
+                        if n < ihl+8 || binary.BigEndian.Uint16(b[ihl+2:]) != port {
+                                continue
+                        }
+                        from := answer(int(b[8]))
+                        if from == nil {
+                                continue
+                        }
+
+                        // Type, code, checksum and the unused word,
+                        // followed by the quoted IP header and the
+                        // first 8 bytes of the datagram, see RFC 792
+                        msg := make([]byte, 8, 8+ihl+8)
+                        msg[0] = 11
+                        if from.Equal(net.IP(b[16:20])) {
+                                msg[0], msg[1] = 3, icmpCodePortUnreachable
+                        }
+                        msg = append(msg, b[:ihl+8]...)
+                        binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+                        fd, err := open(from)
+                        if err != nil {
+                                t.Errorf("unable to answer probes from %v: %v", from, err)
+                                continue
+                        }
+                        to := &syscall.SockaddrInet4{}
+                        copy(to.Addr[:], b[12:16])
+                        if err := syscall.Sendto(fd, msg, 0, to); err != nil {
+                                t.Errorf("unable to answer probe: %v", err)
+                        }
+                }
+        }()
+        t.Cleanup(func() {
+                close(done)
+                wg.Wait()
+        })
+}
+
+// Returns the Internet checksum of the ICMP message, see RFC 1071
+func icmpChecksum(msg []byte) uint16 {
+        var sum uint32
+        for i := 0; i+1 < len(msg); i += 2 {
+                sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+        }
+        if len(msg)%2 == 1 {
+                sum += uint32(msg[len(msg)-1]) << 8
+        }
+        for sum > 0xffff {
+                sum = sum>>16 + sum&0xffff
+        }
+
+        return ^uint16(sum)
+}
+
+func TestSendProbeTTL(t *testing.T) {
+        const port = 33999
+
+        // Capture the probes on the loopback interface, in order to
+        // read the TTL they were sent with
+        raw := openCapture(t)
+
+        tracer := New(&Options{
+                DestinationPort:      port,
+                PacketLength:         8,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                RandomizePayload:     true,
+        })
+        if err := tracer.Open(); err != nil {
+                t.Fatalf("Open: %v", err)
+        }
+        defer tracer.Close()
+
+        // Send the probes concurrently, with a TTL per identifier
+        ttls := map[uint16]int{1: 1, 2: 5, 3: 17, 4: 64, 5: 2, 6: 255}
+        var wg sync.WaitGroup
+        for id, ttl := range ttls {
+                wg.Add(1)
+                go func(id uint16, ttl int) {
+                        defer wg.Done()
+                        if err := tracer.SendProbe(net.IPv4(127, 0, 0, 1), ttl, id); err != nil {
+                                t.Errorf("SendProbe: %v", err)
+                        }
+                }(id, ttl)
+        }
+        wg.Wait()
+
+        seen := make(map[uint16]bool)
+        for len(seen) < len(ttls) {
+                b, ihl := capturePacket(t, raw, port)
+                id := binary.BigEndian.Uint16(b[ihl+8:])
+                if got := int(b[8]); got != ttls[id] {
+                        t.Errorf("probe %d was sent with TTL %d, want %d", id, got, ttls[id])
+                }
+                seen[id] = true
+        }
+
+        // Each probe completes with its own TTL
+        deadline := time.Now().Add(time.Second)
+        completed := 0
+        for completed < len(ttls) && time.Now().Before(deadline) {
+                probes, err := tracer.PollReplies(100 * time.Millisecond)
+                if err != nil {
+                        t.Fatalf("PollReplies: %v", err)
+                }
+                for _, p := range probes {
+                        id := binary.BigEndian.Uint16(p.Payload)
+                        if p.TTL != ttls[id] || !p.Reached {
+                                t.Errorf("probe %d completed with TTL %d and reached %v, want TTL %d and reached", id, p.TTL, p.Reached, ttls[id])
+                        }
+                        completed++
+                }
+        }
+        if completed != len(ttls) {
+                t.Errorf("completed %d of %d probes", completed, len(ttls))
+        }
+}
+
+func TestWarmupFirstHop(t *testing.T) {
+        const port = 33997
+
+        tests := []struct {
+                name   string
+                warmup bool
+                sent   int
+        }{
+                {"disabled", false, 3},
+                {"enabled", true, 4},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        raw := openCapture(t)
+                        tracer := New(&Options{
+                                DestinationPort:      port,
+                                MaxHops:              1,
+                                NumProbes:            3,
+                                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                                WarmupFirstHop:       tc.warmup,
+                        })
+                        result, err := tracer.TraceAll(context.Background(), net.IPv4(127, 0, 0, 1))
+                        if err != nil {
+                                t.Fatalf("TraceAll: %v", err)
+                        }
+
+                        // The throwaway probe is sent, but is not part
+                        // of the result
+                        for i := 0; i < tc.sent; i++ {
+                                if b, _ := capturePacket(t, raw, port); b[8] != 1 {
+                                        t.Errorf("datagram %d was sent with TTL %d, want 1", i, b[8])
+                                }
+                        }
+                        timeout := syscall.NsecToTimeval(int64(100 * time.Millisecond))
+                        if err := syscall.SetsockoptTimeval(raw, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+                                t.Fatal(err)
+                        }
+                        b := make([]byte, 1500)
+                        for {
+                                n, _, err := syscall.Recvfrom(raw, b, 0)
+                                if err != nil {
+                                        break
+                                }
+                                ihl := int(b[0]&0x0f) * 4
+                                if n >= ihl+8 && binary.BigEndian.Uint16(b[ihl+2:]) == port {
+                                        t.Errorf("got more than %d datagrams", tc.sent)
+                                }
+                        }
+
+                        if len(result.Hops) != 1 {
+                                t.Fatalf("got %d hops, want 1", len(result.Hops))
+                        }
+                        hop := result.Hops[0]
+                        if len(hop.Probes) != 3 || hop.Stats.Sent != 3 || hop.Stats.Received != 3 {
+                                t.Errorf("got %d probes with %d of %d received, want 3 of 3", len(hop.Probes), hop.Stats.Received, hop.Stats.Sent)
+                        }
+                })
+        }
+}
+
+func TestPollRepliesReadError(t *testing.T) {
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        })
+        if err := tracer.Open(); err != nil {
+                t.Fatalf("Open: %v", err)
+        }
+        defer tracer.Close()
+
+        // Nothing to read is not an error
+        if _, err := tracer.PollReplies(0); err != nil {
+                t.Fatalf("PollReplies: %v", err)
+        }
+
+        // Reading the error queue of something other than a socket
+        // fails, which has to be reported
+        var pipe [2]int
+        if err := syscall.Pipe(pipe[:]); err != nil {
+                t.Fatal(err)
+        }
+        defer syscall.Close(pipe[0])
+        defer syscall.Close(pipe[1])
+        fd := tracer.sock.fd
+        tracer.sock.fd = pipe[0]
+        _, err := tracer.PollReplies(0)
+        tracer.sock.fd = fd
+        if !errors.Is(err, syscall.ENOTSOCK) {
+                t.Errorf("got error %v, want %v", err, syscall.ENOTSOCK)
+        }
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "errors"
+        "net"
+        "time"
+)
+
+// The managed socket is not available on Windows
+type managedSocket struct{}
+
+// Error of Open on Windows, where IcmpSendEcho2Ex waits for the reply
+// of each probe, which rules out sending probes ahead of their replies
+var errManagedSocketUnsupported = errors.New("managed socket is not supported on windows")
+
+// Open is not supported on Windows and always returns an error.
+func (t *Tracer) Open() error {
+        return errManagedSocketUnsupported
+}
+
+// Close is not supported on Windows and always returns
+// ErrSocketNotOpen.
+func (t *Tracer) Close() error {
+        return ErrSocketNotOpen
+}
+
+// SendProbe is not supported on Windows and always returns
+// ErrSocketNotOpen.
+func (t *Tracer) SendProbe(dest net.IP, ttl int, id uint16) error {
+        return ErrSocketNotOpen
+}
+
+// PollReplies is not supported on Windows and always returns
+// ErrSocketNotOpen.
+func (t *Tracer) PollReplies(timeout time.Duration) ([]Probe, error) {
+        return nil, ErrSocketNotOpen
+}
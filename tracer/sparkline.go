@@ -0,0 +1,94 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "fmt"
+        "io"
+        "strings"
+        "time"
+)
+
+// Block characters used for rendering sparklines, from lowest to
+// highest
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// FprintSparkline writes each hop of the result with a sparkline of
+// the RTTs of its probes, where lost probes are shown as stars. The
+// sparklines of all hops share the same scale, which ranges from zero
+// to the maximum RTT of the trace.
+func FprintSparkline(w io.Writer, r *Result) error {
+        var maxRTT time.Duration
+        for _, hop := range r.Hops {
+                if hop.Stats.Max > maxRTT {
+                        maxRTT = hop.Stats.Max
+                }
+        }
+
+        for _, hop := range r.Hops {
+                addr := "*"
+                if hop.Addr != nil {
+                        addr = hop.Addr.String()
+                }
+
+                var spark strings.Builder
+                for _, p := range hop.Probes {
+                        if !p.Responded() {
+                                spark.WriteRune('*')
+                                continue
+                        }
+                        spark.WriteRune(sparkBlock(p.RTT(), maxRTT))
+                }
+
+                avg := "-"
+                if hop.Stats.Received > 0 {
+                        avg = hop.Stats.Avg.String()
+                }
+                if _, err := fmt.Fprintf(w, "%-3d %-15s %-30s %s %s\n", hop.TTL, addr, orDash(hop.Name), spark.String(), avg); err != nil {
+                        return err
+                }
+        }
+
+        return nil
+}
+
+// Returns the block character representing the given RTT on a scale
+// from zero to max
+func sparkBlock(rtt, max time.Duration) rune {
+        if max <= 0 {
+                return sparkBlocks[0]
+        }
+
+        i := int(int64(rtt) * int64(len(sparkBlocks)-1) / int64(max))
+        if i < 0 {
+                i = 0
+        }
+        if i >= len(sparkBlocks) {
+                i = len(sparkBlocks) - 1
+        }
+
+        return sparkBlocks[i]
+}
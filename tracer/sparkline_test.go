@@ -0,0 +1,102 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "bytes"
+        "net"
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+)
+
+func TestFprintSparkline(t *testing.T) {
+        start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+        probe := func(ttl int, hop net.IP, rtt time.Duration) Probe {
+                return Probe{TTL: ttl, Hop: hop, Start: start, End: start.Add(rtt)}
+        }
+        dest := net.IPv4(198, 51, 100, 1)
+        gw := net.IPv4(192, 0, 2, 1)
+        core := net.IPv4(203, 0, 113, 7)
+        probes := []Probe{
+                probe(1, gw, time.Millisecond),
+                probe(1, gw, 2*time.Millisecond),
+                probe(1, gw, 3*time.Millisecond),
+                probe(2, net.IPv4zero, 0),
+                probe(2, net.IPv4zero, 0),
+                probe(2, net.IPv4zero, 0),
+                probe(3, core, 14*time.Millisecond),
+                probe(3, net.IPv4zero, 0),
+                probe(3, core, 28*time.Millisecond),
+                probe(4, dest, 21*time.Millisecond),
+                probe(4, dest, 7*time.Millisecond),
+                probe(4, dest, 0),
+        }
+        for i := range probes {
+                probes[i].Reached = probes[i].Hop.Equal(dest)
+        }
+        result := NewResult(dest, probes)
+        result.Hops[2].Name = "core.example.net"
+
+        tests := []struct {
+                name   string
+                result *Result
+                golden string
+        }{
+                {"trace", result, "sparkline.txt"},
+                {"empty", &Result{Destination: dest}, ""},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        var got bytes.Buffer
+                        if err := FprintSparkline(&got, tc.result); err != nil {
+                                t.Fatalf("FprintSparkline: %v", err)
+                        }
+                        if tc.golden == "" {
+                                if got.Len() > 0 {
+                                        t.Errorf("got %q, want no output", got.String())
+                                }
+                                return
+                        }
+
+                        golden := filepath.Join("testdata", tc.golden)
+                        if *update {
+                                if err := os.WriteFile(golden, got.Bytes(), 0644); err != nil {
+                                        t.Fatal(err)
+                                }
+                        }
+                        want, err := os.ReadFile(golden)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if !bytes.Equal(got.Bytes(), want) {
+                                t.Errorf("got\n%s\nwant\n%s", got.Bytes(), want)
+                        }
+                })
+        }
+}
@@ -27,12 +27,17 @@ package tracer
 
 import (
         "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "math/rand"
         "net"
+        "net/url"
+        "strings"
+        "sync"
+        "sync/atomic"
         "syscall"
         "time"
-        "unsafe"
-
-        "golang.org/x/net/ipv4"
 )
 
 // See https://github.com/torvalds/linux/blob/master/include/uapi/linux/errqueue.h#L28
@@ -49,6 +54,59 @@ const (
         SockExtendedErrorOriginTimestamp = SockExtendedErrorOriginTxStatus
 )
 
+// ErrFirstHopUnreachable is the error of the final probe of a trace,
+// which was aborted because the first hop did not respond to any of
+// the probes, when Options.FailFastOnFirstHop is set.
+var ErrFirstHopUnreachable = errors.New("first hop is unreachable, check the local network and permissions")
+
+// ErrNoRoute is the error of the final probe of a trace, which was
+// aborted because there is no route to the destination. It wraps the
+// underlying ENETUNREACH or EHOSTUNREACH error.
+var ErrNoRoute = errors.New("no route to the destination")
+
+// ErrProbeLost is the error of the final probe of a trace, which was
+// aborted because one of its probes did not receive a response, when
+// Options.FailFast is set.
+var ErrProbeLost = errors.New("probe did not receive a response")
+
+// ErrSocketNotOpen is returned by SendProbe and PollReplies, if the
+// managed socket has not been set up via Open.
+var ErrSocketNotOpen = errors.New("socket is not open")
+
+// SetupError is the error of a trace, which failed while setting up
+// the sockets for sending the probes.
+type SetupError struct {
+        // Phase is the setup step which failed, e.g. "socket",
+        // "setsockopt IP_TTL", "bind" or "epoll"
+        Phase string
+
+        // TTL of the probes being set up
+        TTL int
+
+        // Options is a copy of the options in effect
+        Options Options
+
+        // Err is the underlying error
+        Err error
+}
+
+// Error implements the error interface.
+func (e *SetupError) Error() string {
+        return fmt.Sprintf("%s failed for TTL %d: %v", e.Phase, e.TTL, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SetupError) Unwrap() error {
+        return e.Err
+}
+
+// Default TTL of the probe sent by Options.ProbeDestinationDirectly
+const defaultDirectProbeTTL = 64
+
+// IP Router Alert option with a value of zero, i.e. the router should
+// examine the packet, see RFC 2113
+var routerAlertOption = []byte{0x94, 0x04, 0x00, 0x00}
+
 // See https://github.com/torvalds/linux/blob/master/include/uapi/linux/errqueue.h#L15
 type SockExtendedErr struct {
         Errno  uint32
@@ -60,11 +118,121 @@ type SockExtendedErr struct {
         Data   uint32
 }
 
+// Method represents the mechanism used for sending the probes and
+// receiving the replies.
+type Method int
+
+const (
+        // MethodUDPRecvErr sends the probes as UDP datagrams and reads
+        // the ICMP errors from the error queue of the socket via
+        // IP_RECVERR, which requires no privileges.
+        MethodUDPRecvErr Method = iota
+
+        // MethodICMPEcho sends the probes as ICMP echo requests via
+        // IcmpSendEcho2Ex of the IP Helper API, which is used on
+        // Windows.
+        MethodICMPEcho
+)
+
+// String implements the fmt.Stringer interface.
+func (m Method) String() string {
+        switch m {
+        case MethodUDPRecvErr:
+                return "udp-recverr"
+        case MethodICMPEcho:
+                return "icmp-echo"
+        default:
+                return fmt.Sprintf("Method(%d)", int(m))
+        }
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (m Method) MarshalText() ([]byte, error) {
+        return []byte(m.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (m *Method) UnmarshalText(text []byte) error {
+        switch string(text) {
+        case "udp-recverr":
+                *m = MethodUDPRecvErr
+        case "icmp-echo":
+                *m = MethodICMPEcho
+        default:
+                return fmt.Errorf("unknown method %q", text)
+        }
+
+        return nil
+}
+
+// ClockSource represents the clock, which timestamps the probes and
+// their replies.
+type ClockSource int
+
+const (
+        // ClockMonotonic timestamps the probes in user space, using the
+        // monotonic clock of the Go runtime
+        ClockMonotonic ClockSource = iota
+
+        // ClockKernel uses the software timestamps taken by the kernel
+        // when sending the probes and receiving the replies, via
+        // SO_TIMESTAMPING
+        ClockKernel
+
+        // ClockHardware uses the timestamps taken by the network
+        // interface, via SO_TIMESTAMPING. Hardware timestamping must
+        // be enabled on the interface, e.g. via hwstamp_ctl.
+        ClockHardware
+)
+
+// String implements the fmt.Stringer interface.
+func (c ClockSource) String() string {
+        switch c {
+        case ClockMonotonic:
+                return "monotonic"
+        case ClockKernel:
+                return "kernel"
+        case ClockHardware:
+                return "hardware"
+        default:
+                return fmt.Sprintf("ClockSource(%d)", int(c))
+        }
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (c ClockSource) MarshalText() ([]byte, error) {
+        return []byte(c.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (c *ClockSource) UnmarshalText(text []byte) error {
+        switch string(text) {
+        case "monotonic":
+                *c = ClockMonotonic
+        case "kernel":
+                *c = ClockKernel
+        case "hardware":
+                *c = ClockHardware
+        default:
+                return fmt.Errorf("unknown clock source %q", text)
+        }
+
+        return nil
+}
+
 // Options provide configuration settings for the Tracer.
 type Options struct {
         // "Unlikely" destination port to use when tracing.
         DestinationPort uint16
 
+        // DistinctPorts specifies whether to send each probe of a hop
+        // to a different destination port, i.e. DestinationPort plus
+        // the index of the probe, wrapping around to port 1 past
+        // 65535. Routers which balance the load per flow may then
+        // forward each probe on a different path, which reveals all of
+        // the responding addresses per TTL in a single pass.
+        DistinctPorts bool
+
         // Specifies the maximum number of hops (max time-to-live) the
         // Tracer will probe.
         MaxHops int
@@ -72,11 +240,336 @@ type Options struct {
         // Specifies the number of probes to send per hop.
         NumProbes uint
 
+        // AdaptiveProbes specifies whether to adapt the number of
+        // probes of a hop to its loss. A hop, which answered each of
+        // its first MinAdaptiveProbes probes, is confirmed clean and
+        // gets no more probes. A hop with partial loss among its
+        // NumProbes probes gets additional probes, up to
+        // MaxAdaptiveProbes in total, in order to get a better
+        // estimate of its RTT. Hops which answer none of the probes
+        // get the regular NumProbes.
+        AdaptiveProbes bool
+
+        // MinAdaptiveProbes specifies the number of probes, which
+        // confirm a hop as clean when AdaptiveProbes is set. If zero,
+        // half of NumProbes, rounded up.
+        MinAdaptiveProbes uint
+
+        // MaxAdaptiveProbes specifies the maximum number of probes per
+        // hop when AdaptiveProbes is set. If zero, twice NumProbes.
+        MaxAdaptiveProbes uint
+
         // Specifies how long to wait for a response to a probe.
         ProbeMaxWaitDuration time.Duration
 
-        // PacketLength represents the size of the probe packets
+        // DestProbeTimeout specifies how long to wait for a response
+        // of the destination. The destination generates the port
+        // unreachable errors in its own stack, which is often slower
+        // or rate limited. Since it is unknown which hop reaches the
+        // destination, until the destination responded, a probe
+        // without any response within ProbeMaxWaitDuration keeps
+        // waiting until DestProbeTimeout, but only accepts a response
+        // of the destination in the meantime. This also prolongs the
+        // probes of hops which do not respond at all, but not the
+        // remaining probes of a hop, once a router other than the
+        // destination responded to one of them. If not longer than
+        // ProbeMaxWaitDuration, it has no effect.
+        DestProbeTimeout time.Duration
+
+        // MinPlausibleRTT specifies the RTT below which a reply is
+        // considered suspicious, e.g. a spurious immediate reply of
+        // the local stack. Such probes are still delivered, but have
+        // Probe.Implausible set, so it is up to the caller whether to
+        // discard them. If zero, no reply is flagged.
+        MinPlausibleRTT time.Duration
+
+        // MaxAcceptableRTT specifies a latency budget for the path.
+        // Probes whose reply took longer have Probe.RTTExceeded set,
+        // and the trace stops after the hop of the first such probe,
+        // as if the destination had been reached. The remaining
+        // probes of that hop, including the adaptive ones, are still
+        // sent. Only responses are checked, so a hop losing all of its
+        // probes never stops the trace. If zero, the RTT is unlimited.
+        MaxAcceptableRTT time.Duration
+
+        // SuppressStars specifies whether to omit the probes, which did
+        // not receive a response. When set, only the responding probes
+        // are emitted, and consumers have to track the TTLs of the
+        // probes to see where the gaps are. The TTLs are advanced and
+        // the trace terminates the same either way. The loss
+        // statistics of TraceAll account for all probes regardless.
+        SuppressStars bool
+
+        // ClockSource specifies the preferred clock for measuring the
+        // RTT of the probes. If the kernel or the network interface do
+        // not provide the timestamps of both the probe and its reply,
+        // the probe falls back to the next less precise clock. The
+        // clock actually used is recorded in Probe.ClockSource. The
+        // probes of SendProbe always use ClockMonotonic.
+        ClockSource ClockSource
+
+        // CoarseTiming specifies whether to timestamp the probes of a
+        // trace with a cached time, which a background ticker updates
+        // every millisecond, instead of reading the clock for every
+        // probe. This reduces the overhead of large numbers of
+        // concurrent traces, at the expense of accuracy: the RTTs are
+        // quantized to the ticker interval, so they may be off by up
+        // to a millisecond, or more on a loaded system, and replies
+        // faster than that may have a zero RTT. It only applies to
+        // ClockMonotonic, the kernel and hardware timestamps are used
+        // as usual, if available.
+        CoarseTiming bool
+
+        // PacketLength represents the size of the UDP payload of the
+        // probes in bytes, which is sent exactly as is, without any
+        // padding. The IP and UDP headers add another 28 bytes on the
+        // wire. Linux enforces no minimum, so zero sends empty
+        // datagrams, while the maximum is 65507 bytes. Probes larger
+        // than the path MTU are fragmented.
         PacketLength int
+
+        // ProbeSendOffsets specifies the time at which each probe of a
+        // hop is sent, relative to the start of the hop, e.g. {0, 10ms,
+        // 100ms}. Staggering the probes helps to detect routers whose
+        // RTT depends on the send cadence, e.g. due to interrupt
+        // coalescing or polling. A probe is never sent before the reply
+        // to the previous one was received or timed out, so offsets
+        // shorter than that have no effect. Probes without an offset
+        // are sent immediately.
+        ProbeSendOffsets []time.Duration
+
+        // WarmupFirstHop specifies whether to send a throwaway probe to
+        // the first hop before measuring it. The very first packet
+        // towards the gateway may be delayed by ARP or neighbor
+        // discovery, which would otherwise show up as an RTT spike of
+        // the first hop. The warm-up probe is not reported.
+        WarmupFirstHop bool
+
+        // ProbeDestinationDirectly specifies whether TraceAll sends a
+        // single probe with DirectProbeTTL to the destination before
+        // the trace, which confirms whether the destination is alive,
+        // even if the path to it cannot be traced, e.g. due to a black
+        // hole. The probe is reported in Result.DirectProbe, and is
+        // not part of the hops. DirectProbeTTL defaults to 64 if zero.
+        ProbeDestinationDirectly bool
+        DirectProbeTTL           int
+
+        // SendBufferSize specifies the size of the socket send buffer
+        // in bytes, which is set via SO_SNDBUF. Raising it avoids
+        // ENOBUFS when many probes are sent in a short time, e.g. when
+        // tracing many destinations at once with TraceMany. The kernel
+        // doubles the given value and caps it at net.core.wmem_max. A
+        // value of zero keeps the system default.
+        SendBufferSize int
+
+        // SocketPriority specifies the Linux socket priority of the
+        // probes, which is set via SO_PRIORITY and used by the queuing
+        // discipline for classifying the packets, e.g. by the prio
+        // qdisc or the skbedit and priority filters. Priorities from 1
+        // to 6 may be set by any process, higher ones require
+        // CAP_NET_ADMIN. A value of zero leaves the priority unset.
+        SocketPriority int
+
+        // Mark specifies the firewall mark of the probes, which is set
+        // via SO_MARK and may be used by policy routing rules for
+        // selecting the routing table. Setting it requires
+        // CAP_NET_ADMIN. A value of zero leaves the mark unset.
+        Mark uint32
+
+        // RouterAlert specifies whether to include the IP Router Alert
+        // option (RFC 2113) in the header of the probes, which is set
+        // via IP_OPTIONS. This is useful for testing middleboxes which
+        // treat such packets differently. It requires no privileges on
+        // Linux, but some kernels or security modules refuse setting
+        // IP options, and many routers drop or rate limit packets with
+        // options, so expect more loss than without it.
+        RouterAlert bool
+
+        // EmitFirstResponse specifies whether to deliver the first
+        // responding probe of each hop as soon as it completes and
+        // continue with the next hop right away, while the remaining
+        // probes of the hop keep running in the background. The
+        // remaining probes are delivered later and are marked as
+        // refinements, which means that probes of different hops may
+        // be interleaved.
+        EmitFirstResponse bool
+
+        // RandomizePayload specifies whether to fill the payload of
+        // each probe with random bytes, so that routers which dedup
+        // identical packets do not collapse back-to-back probes.
+        RandomizePayload bool
+
+        // UniquePayloadPerProbe specifies whether to start the payload
+        // of each probe with a random nonce of 8 bytes, so that
+        // middleboxes which cache responses per payload see a fresh
+        // flow on every probe. Since the nonce is part of the quoted
+        // payload, late replies to previous probes are never matched
+        // to the current one. The nonce is truncated, if PacketLength
+        // is shorter than 8 bytes. It is ignored by custom encoders.
+        UniquePayloadPerProbe bool
+
+        // Encoder specifies a custom encoder of the probe payloads. If
+        // nil, the probes are encoded according to PacketLength and
+        // RandomizePayload.
+        Encoder ProbeEncoder
+
+        // ReplyParsers specifies custom parsers of the replies, whose
+        // results are attached to Probe.Extensions
+        ReplyParsers []ReplyParser
+
+        // RandomizeTTLOrder specifies whether to probe the TTLs in a
+        // random order. Probing them in sequence hits the ICMP rate
+        // limiter of each router in a predictable burst, which spreads
+        // out when shuffled. Since the TTL reaching the destination is
+        // not known in advance, all TTLs up to MaxHops are probed. The
+        // probes are delivered in the order they were sent, while
+        // TraceAll orders the hops of the Result by TTL and drops the
+        // ones beyond the destination.
+        RandomizeTTLOrder bool
+
+        // RandSeed specifies the seed of the random source used by the
+        // Tracer. A value of zero uses a time-based seed.
+        RandSeed int64
+
+        // RandSource specifies the random source used by the Tracer,
+        // which takes precedence over RandSeed. All randomized behavior
+        // of the Tracer, i.e. RandomizePayload and RandomizeTTLOrder,
+        // draws from this single source, so a fixed seed reproduces the
+        // same payloads and TTL order. Traces running concurrently on
+        // the same Tracer share the source, which makes them
+        // reproducible only when run one after another.
+        RandSource rand.Source
+
+        // ResolveNames specifies whether to resolve the names of the
+        // discovered hops via reverse DNS lookups.
+        ResolveNames bool
+
+        // VerifyNames specifies whether to look up the addresses of
+        // the names resolved via ResolveNames, and to flag the probes
+        // whose hop is not among them via Probe.DNSMismatch. A reverse
+        // name which does not resolve back to the hop can indicate
+        // stale or spoofed reverse DNS. It has no effect, unless
+        // ResolveNames is set.
+        VerifyNames bool
+
+        // SourceAddr specifies the local address to send the probes
+        // from. If nil, the address is chosen by the kernel.
+        SourceAddr net.IP
+
+        // SourcePortMin and SourcePortMax specify a range of source
+        // ports to sweep, e.g. for mapping which ports traverse a
+        // filtering hop. Each probe is sent from the next port of the
+        // range, wrapping around at its end. The probes are sent one
+        // at a time as usual, which bounds the rate of the sweep. Only
+        // sweep networks you are authorized to test, and spread the
+        // probes via ProbeSendOffsets where needed. If either is
+        // zero, the source port is chosen by the kernel.
+        SourcePortMin uint16
+        SourcePortMax uint16
+
+        // FreeBind specifies whether to set IP_FREEBIND on the probe
+        // socket, so that SourceAddr may be an address which is not
+        // (yet) configured on any local interface, e.g. an anycast or
+        // failover address. Some kernels and security policies require
+        // CAP_NET_ADMIN for it.
+        FreeBind bool
+
+        // FailFastOnFirstHop specifies whether to abort the trace with
+        // ErrFirstHopUnreachable, if none of the probes to the first
+        // hop received a response. This usually points to a local
+        // network or permission problem, in which case the rest of the
+        // trace would only report timeouts.
+        FailFastOnFirstHop bool
+
+        // FailFast specifies whether to abort the trace with
+        // ErrProbeLost, as soon as any probe does not receive a
+        // response. Errors of the trace itself, i.e. a SetupError, a
+        // failure to encode or send a probe, and ErrNoRoute, always
+        // terminate the trace. Probes which received an ICMP error
+        // from a hop are responses, not errors, and do not trigger it.
+        // The lost probe is delivered as usual, subject to SuppressStars,
+        // and followed by the error.
+        FailFast bool
+
+        // DetectLoops specifies whether to stop the trace once it has
+        // run into a routing loop, i.e. the same address responded at
+        // more than LoopThreshold distinct TTLs. The probe revealing
+        // the loop has Probe.Looped set, the remaining probes of its
+        // hop are still sent, and TraceAll reports the loop in
+        // Result.Loop. An address responding at a couple of TTLs, e.g.
+        // a router which does not decrement the TTL, is not a loop.
+        DetectLoops bool
+
+        // LoopThreshold specifies the number of distinct TTLs at which
+        // the same address may respond, before DetectLoops considers
+        // the path to loop. If zero, it defaults to 2.
+        LoopThreshold int
+
+        // PinCPU specifies whether to pin the prober goroutine to the
+        // given CPU during a trace, which reduces scheduling noise in
+        // the measured RTT. The goroutine is locked to an OS thread,
+        // whose affinity is set via sched_setaffinity(2) on Linux, or
+        // SetThreadAffinityMask on Windows.
+        //
+        // No capabilities are needed for pinning our own thread, but
+        // pinning to a CPU outside of the allowed CPU set of the
+        // process (e.g. when restricted by cgroups or taskset(1))
+        // fails with EINVAL.
+        PinCPU bool
+        CPU    int
+
+        // IncrementalRTT specifies whether TraceAll should compute the
+        // incremental RTT of each hop, i.e. the latency added by the
+        // segment between the hop and its closest responding
+        // predecessor.
+        IncrementalRTT bool
+
+        // ConfirmThreshold specifies the number of probes of a hop,
+        // which must receive a response from the same address for
+        // TraceAll to mark the hop as confirmed. This filters out
+        // transient, spoofed or leaked replies. A value of one or less
+        // confirms a hop with any response.
+        ConfirmThreshold int
+
+        // MaxRetainedProbes specifies the maximum number of probes per
+        // hop, which TraceAll retains in the Result. The statistics of a
+        // hop always cover all of its probes, but beyond the cap only the
+        // running count, min/avg/max and standard deviation are kept,
+        // not the raw samples, which bounds the memory used for large
+        // NumProbes. Anything derived from the raw samples, such as
+        // sparklines or exports, only sees the retained probes. A value
+        // of zero retains all probes.
+        MaxRetainedProbes int
+
+        // OnHopDiscovered is invoked once per TTL, as soon as the first
+        // probe with that TTL receives a response, and before the probe
+        // itself is delivered. This allows drawing the skeleton of the
+        // path before all probes of a hop have completed. It is invoked
+        // from the goroutine probing the hop, so it should not block.
+        // Since the hops are probed concurrently when EmitFirstResponse
+        // is set, and so are the traces of TraceMany, it must be safe
+        // for concurrent use.
+        OnHopDiscovered func(HopDiscovered)
+
+        // TimingHook is invoked after every wait for a reply to a
+        // probe sent by Trace, with the internal timing of the wait.
+        // A single probe may wait more than once, e.g. when its send
+        // timestamps or unrelated errors arrive first. It is invoked
+        // from the goroutine probing the hop, so it should not block,
+        // and like OnHopDiscovered it must be safe for concurrent use.
+        TimingHook func(TimingEvent)
+
+        // Minimum change of the loss percentage of a hop, which
+        // TraceDiff reports as a change
+        LossChangeThreshold float64
+
+        // Minimum absolute and relative change of the average RTT of
+        // a hop, which TraceDiff reports as a change. The change has
+        // to exceed both, so that neither jitter on fast hops, nor
+        // small relative changes on slow hops are reported. The
+        // relative change is in percent of the old average RTT.
+        RTTChangeAbsolute time.Duration
+        RTTChangeRelative float64
 }
 
 // Default options for the Tracer
@@ -86,6 +579,9 @@ var DefaultOptions = &Options{
         NumProbes:            3,
         ProbeMaxWaitDuration: 500 * time.Millisecond,
         PacketLength:         60,
+        LossChangeThreshold:  10,
+        RTTChangeAbsolute:    5 * time.Millisecond,
+        RTTChangeRelative:    20,
 }
 
 // Tracer implements the traditional, ancient method of tracerouting,
@@ -93,6 +589,23 @@ var DefaultOptions = &Options{
 // destination port.
 type Tracer struct {
         opts *Options
+
+        // Encoder of the probe payloads
+        encoder ProbeEncoder
+
+        // Source of randomness and position of the source port sweep,
+        // guarded by mu
+        mu      sync.Mutex
+        rng     *rand.Rand
+        portSeq int
+
+        // Managed socket of SendProbe and PollReplies, guarded by sockMu
+        sockMu sync.Mutex
+        sock   *managedSocket
+
+        // In-flight operations cancelled by Shutdown, which are shared
+        // with the clones of the Tracer
+        ops *operations
 }
 
 // New creates a new Tracer with the given options.
@@ -101,76 +614,655 @@ func New(opts *Options) *Tracer {
                 opts = DefaultOptions
         }
 
+        src := opts.RandSource
+        if src == nil {
+                seed := opts.RandSeed
+                if seed == 0 {
+                        seed = time.Now().UnixNano()
+                }
+                src = rand.NewSource(seed)
+        }
+
         tracer := &Tracer{
                 opts: opts,
+                rng:  rand.New(src),
+                ops:  newOperations(),
+        }
+
+        tracer.encoder = opts.Encoder
+        if tracer.encoder == nil {
+                tracer.encoder = &udpEncoder{tracer: tracer}
         }
 
         return tracer
 }
 
+// Returns a new Tracer with a copy of the options, as modified by the
+// given function. The random source of the new Tracer is seeded from
+// the one of this Tracer, and the traces of the new Tracer are
+// tracked along with the ones of this Tracer, so that Shutdown covers
+// them.
+func (t *Tracer) clone(modify func(opts *Options)) *Tracer {
+        t.mu.Lock()
+        seed := t.rng.Int63()
+        t.mu.Unlock()
+
+        opts := t.Options()
+        opts.RandSource = nil
+        opts.RandSeed = seed
+        modify(&opts)
+
+        c := New(&opts)
+        c.ops = t.ops
+
+        return c
+}
+
+// Options returns a copy of the options used by the Tracer. The
+// slices and addresses are copied as well, so that modifying them does
+// not affect the Tracer. The Encoder, the RandSource and the callbacks
+// are shared.
+func (t *Tracer) Options() Options {
+        opts := *t.opts
+        opts.ProbeSendOffsets = append([]time.Duration(nil), t.opts.ProbeSendOffsets...)
+        opts.ReplyParsers = append([]ReplyParser(nil), t.opts.ReplyParsers...)
+        opts.SourceAddr = append(net.IP(nil), t.opts.SourceAddr...)
+
+        return opts
+}
+
+// HopDiscovered represents the first discovery of the hop at a given
+// TTL.
+type HopDiscovered struct {
+        // TTL of the discovered hop
+        TTL int
+
+        // IP of the discovered hop
+        IP net.IP
+}
+
+// WaitOutcome describes why a wait for a reply returned.
+type WaitOutcome int
+
+const (
+        // WaitReady means the error queue of the socket became readable
+        WaitReady WaitOutcome = iota
+
+        // WaitTimeout means the wait timed out
+        WaitTimeout
+
+        // WaitFailed means the wait failed, e.g. it was interrupted
+        WaitFailed
+)
+
+// String implements the fmt.Stringer interface.
+func (o WaitOutcome) String() string {
+        switch o {
+        case WaitReady:
+                return "ready"
+        case WaitTimeout:
+                return "timeout"
+        case WaitFailed:
+                return "failed"
+        default:
+                return fmt.Sprintf("WaitOutcome(%d)", int(o))
+        }
+}
+
+// TimingEvent represents a single wait for a reply to a probe, as
+// reported to Options.TimingHook.
+type TimingEvent struct {
+        // TTL of the probe
+        TTL int
+
+        // Index of the probe within its hop
+        ProbeIndex int
+
+        // Sent is the time at which the probe was sent
+        Sent time.Time
+
+        // Timeout is the maximum duration of the wait
+        Timeout time.Duration
+
+        // Blocked is for how long the wait actually blocked
+        Blocked time.Duration
+
+        // Outcome of the wait
+        Outcome WaitOutcome
+}
+
 // Probe represents a trace probe
 type Probe struct {
         // Start time of the probe
-        Start time.Time
+        Start time.Time `json:"start"`
 
         // End time of the probe
-        End time.Time
+        End time.Time `json:"end"`
 
         // IP of the discovered hop
-        Hop net.IP
+        Hop net.IP `json:"hop"`
 
         // TTL of the probe
-        TTL int
+        TTL int `json:"ttl"`
+
+        // Reached is true, if the probe was answered by the
+        // destination. This is also the case when the destination
+        // replied from an address other than the one being traced, in
+        // which case RepliedFrom is set as well.
+        Reached bool `json:"reached"`
+
+        // RepliedFrom is the address from which the destination replied,
+        // if it differs from the traced destination, e.g. for anycast
+        // or NAT64 targets. It is nil otherwise.
+        RepliedFrom net.IP `json:"replied_from,omitempty"`
+
+        // ReplyBytes is the number of bytes received with the ICMP
+        // reply, i.e. the part of our payload quoted by the hop. It is
+        // less than SentBytes, if the hop truncated the quote, and may
+        // exceed it, if the hop appended ICMP extensions (RFC 4884).
+        ReplyBytes int `json:"reply_bytes"`
+
+        // SentBytes is the size of the UDP payload of the probe
+        SentBytes int `json:"sent_bytes"`
+
+        // Port is the destination port of the probe
+        Port uint16 `json:"port"`
+
+        // SourcePort is the source port of the probe
+        SourcePort uint16 `json:"source_port"`
+
+        // QuotedDestination is the destination of our datagram, as
+        // quoted in the ICMP reply. It differs from the traced
+        // destination, if the probe was redirected on its way, e.g.
+        // by policy routing.
+        QuotedDestination net.IP `json:"quoted_destination,omitempty"`
+
+        // InterfaceIndex is the index of the local interface the probe
+        // left from, as reported by IP_PKTINFO along with its transmit
+        // timestamp. Zero if the kernel did not report it.
+        InterfaceIndex int `json:"interface_index,omitempty"`
+
+        // ClockSource is the clock, which timestamped the probe and
+        // its reply
+        ClockSource ClockSource `json:"clock_source"`
+
+        // ReplyTTL is the remaining TTL of the IP packet carrying the
+        // ICMP reply, as it arrived, or zero if unknown
+        ReplyTTL int `json:"reply_ttl,omitempty"`
+
+        // ReverseHopEstimate is the estimated number of hops of the
+        // return path from the responding router, derived from the
+        // ReplyTTL and the most likely initial TTL of the router, or
+        // zero if unknown. It is comparable with TTL, so a difference
+        // hints at an asymmetric path, but an unusual initial TTL
+        // throws it off.
+        ReverseHopEstimate int `json:"reverse_hop_estimate,omitempty"`
+
+        // Name of the discovered hop, if Options.ResolveNames is set
+        // and the reverse DNS lookup succeeded
+        Name string `json:"name,omitempty"`
+
+        // ForwardAddrs provides the addresses of Name, if
+        // Options.VerifyNames is set and the forward lookup succeeded
+        ForwardAddrs []net.IP `json:"forward_addrs,omitempty"`
+
+        // DNSMismatch is true, if Options.VerifyNames is set and the
+        // hop is not among the addresses of its name
+        DNSMismatch bool `json:"dns_mismatch,omitempty"`
+
+        // Payload of the probe, if Options.RandomizePayload,
+        // Options.UniquePayloadPerProbe or Options.Encoder is set
+        Payload []byte `json:"payload,omitempty"`
+
+        // Extensions provides the results of Options.ReplyParsers for
+        // the reply to the probe
+        Extensions []any `json:"extensions,omitempty"`
+
+        // Refinement is true, if the probe was delivered after the
+        // first responding probe of its hop, when
+        // Options.EmitFirstResponse is set
+        Refinement bool `json:"refinement"`
+
+        // SendOffset is the time at which the probe was actually sent,
+        // relative to the start of its hop
+        SendOffset time.Duration `json:"send_offset"`
+
+        // Implausible is true, if the probe received a reply faster
+        // than Options.MinPlausibleRTT
+        Implausible bool `json:"implausible"`
+
+        // RTTExceeded is true, if the probe received a reply slower
+        // than Options.MaxAcceptableRTT
+        RTTExceeded bool `json:"rtt_exceeded"`
+
+        // Looped is true, if the probe revealed a routing loop, when
+        // Options.DetectLoops is set
+        Looped bool `json:"looped"`
+
+        // Tag is the value passed to TraceWithTag, which allows
+        // correlating the probes of concurrent traces. It is not
+        // encoded as JSON, since it may hold arbitrary state.
+        Tag any `json:"-"`
 
         // Error provides the error which may have occurred during
         // tracing
-        Error error
+        Error error `json:"error,omitempty"`
+}
+
+// RTT returns the round-trip time of the probe.
+func (p Probe) RTT() time.Duration {
+        return p.End.Sub(p.Start)
+}
+
+// Responded returns true, if the probe received a response from a
+// hop.
+func (p Probe) Responded() bool {
+        return p.Error == nil && p.Hop != nil && !p.Hop.Equal(net.IPv4zero)
+}
+
+// MarshalJSON implements the json.Marshaler interface. The error of
+// the probe, if any, is encoded as its message.
+func (p Probe) MarshalJSON() ([]byte, error) {
+        type probe Probe
+        aux := struct {
+                probe
+                Error string `json:"error,omitempty"`
+        }{
+                probe: probe(p),
+        }
+        if p.Error != nil {
+                aux.Error = p.Error.Error()
+        }
+
+        return json.Marshal(aux)
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. The error
+// of the probe, if any, is restored from its message, which means
+// that the original error type is not preserved.
+func (p *Probe) UnmarshalJSON(data []byte) error {
+        type probe Probe
+        aux := struct {
+                *probe
+                Error string `json:"error,omitempty"`
+        }{
+                probe: (*probe)(p),
+        }
+        if err := json.Unmarshal(data, &aux); err != nil {
+                return err
+        }
+
+        p.Error = nil
+        if aux.Error != "" {
+                p.Error = errors.New(aux.Error)
+        }
+
+        return nil
 }
 
 // Trace traces the hops between us and the destination.
 func (t *Tracer) Trace(ctx context.Context, dest net.IP) <-chan Probe {
+        return t.tracePath(ctx, dest, nil)
+}
+
+// Traces the hops between us and the destination like Trace. Records
+// to interrupted, unless nil, whether the context stopped the trace
+// before it completed.
+func (t *Tracer) tracePath(ctx context.Context, dest net.IP, interrupted *atomic.Bool) <-chan Probe {
+        ttls := make([]int, 0, t.opts.MaxHops)
+        for ttl := 1; ttl <= t.opts.MaxHops; ttl++ {
+                ttls = append(ttls, ttl)
+        }
+
+        // In random order we cannot tell which TTL reaches the
+        // destination first, until all of them have been probed
+        if t.opts.RandomizeTTLOrder {
+                t.mu.Lock()
+                t.rng.Shuffle(len(ttls), func(i, j int) {
+                        ttls[i], ttls[j] = ttls[j], ttls[i]
+                })
+                t.mu.Unlock()
+                return t.trace(ctx, dest, ttls, false, interrupted)
+        }
+
+        return t.trace(ctx, dest, ttls, true, interrupted)
+}
+
+// TraceWithTimeout traces the hops between us and the destination,
+// giving up after the given duration. The probes collected so far are
+// delivered before the channel is closed.
+func (t *Tracer) TraceWithTimeout(dest net.IP, d time.Duration) <-chan Probe {
+        ctx, cancel := context.WithTimeout(context.Background(), d)
+        in := t.Trace(ctx, dest)
+        out := make(chan Probe)
+
+        go func() {
+                defer cancel()
+                defer close(out)
+                for probe := range in {
+                        out <- probe
+                }
+        }()
+
+        return out
+}
+
+// TraceWithTag works like Trace, but sets the given tag on every
+// delivered probe, including the final probe of a failed trace.
+func (t *Tracer) TraceWithTag(ctx context.Context, dest net.IP, tag any) <-chan Probe {
+        in := t.Trace(ctx, dest)
+        out := make(chan Probe)
+
+        go func() {
+                defer close(out)
+                for probe := range in {
+                        probe.Tag = tag
+                        out <- probe
+                }
+        }()
+
+        return out
+}
+
+// TraceTarget traces the hops between us and the given target, which
+// may be a host name or address, a host:port pair, or a URL. The host
+// is resolved to its IPv4 address. If the target provides a port, or
+// a URL scheme with a well-known port, the probes are sent to that
+// port instead of Options.DestinationPort.
+func (t *Tracer) TraceTarget(ctx context.Context, target string) (<-chan Probe, error) {
+        host, port, err := parseTarget(target)
+        if err != nil {
+                return nil, err
+        }
+
+        addr, err := net.ResolveIPAddr("ip4", host)
+        if err != nil {
+                return nil, fmt.Errorf("unable to resolve target %q: %w", target, err)
+        }
+
+        if port == 0 {
+                return t.Trace(ctx, addr.IP), nil
+        }
+
+        tracer := t.clone(func(opts *Options) {
+                opts.DestinationPort = port
+        })
+
+        return tracer.Trace(ctx, addr.IP), nil
+}
+
+// Returns the host and port of the given target, which may be a host,
+// a host:port pair or a URL. The port is zero, if the target does not
+// specify one.
+func parseTarget(target string) (string, uint16, error) {
+        var host, port string
+        switch {
+        case strings.Contains(target, "://"):
+                u, err := url.Parse(target)
+                if err != nil {
+                        return "", 0, fmt.Errorf("invalid target %q: %w", target, err)
+                }
+                host, port = u.Hostname(), u.Port()
+                if port == "" {
+                        port = u.Scheme
+                }
+        case strings.Count(target, ":") == 1 || strings.HasPrefix(target, "["):
+                var err error
+                host, port, err = net.SplitHostPort(target)
+                if err != nil {
+                        return "", 0, fmt.Errorf("invalid target %q: %w", target, err)
+                }
+        default:
+                host = target
+        }
+        if host == "" {
+                return "", 0, fmt.Errorf("invalid target %q: missing host", target)
+        }
+        if port == "" {
+                return host, 0, nil
+        }
+
+        number, err := net.LookupPort("udp", port)
+        if err != nil {
+                number, err = net.LookupPort("tcp", port)
+        }
+        if err != nil || number <= 0 || number > 65535 {
+                return "", 0, fmt.Errorf("invalid port in target %q", target)
+        }
+
+        return host, uint16(number), nil
+}
+
+// TraceTTLs probes the destination with each of the given TTLs in
+// order, e.g. {1, 5, 10, 15}, instead of a contiguous range of TTLs.
+// All of the given TTLs are probed, even if the destination is reached
+// by an earlier one.
+func (t *Tracer) TraceTTLs(ctx context.Context, dest net.IP, ttls []int) <-chan Probe {
+        return t.trace(ctx, dest, ttls, false, nil)
+}
+
+// Probes the destination with the given TTLs, optionally stopping once
+// the destination has been reached. Records to interrupted, unless
+// nil, whether the context stopped the probing of the TTLs.
+func (t *Tracer) trace(ctx context.Context, dest net.IP, ttls []int, stopOnReach bool, interrupted *atomic.Bool) <-chan Probe {
+        ctx, untrack, err := t.track(ctx)
+        if err != nil {
+                ch := make(chan Probe, 1)
+                ch <- Probe{Error: err}
+                close(ch)
+                return ch
+        }
+
         ch := make(chan Probe)
 
+        // The trace may end in several ways, but the channel must be
+        // closed exactly once, and only after the hops probed in the
+        // background are done sending
+        var closeOnce sync.Once
+        closeCh := func() {
+                closeOnce.Do(func() { close(ch) })
+        }
+
         prober := func() {
-                ttl := 0
+                defer untrack()
+                if t.opts.CoarseTiming {
+                        coarse.acquire()
+                        defer coarse.release()
+                }
+                if t.opts.PinCPU {
+                        if err := pinCPU(t.opts.CPU); err != nil {
+                                ch <- Probe{Error: err}
+                                closeCh()
+                                return
+                        }
+                }
+
+                // Probes of the hops which keep running in the
+                // background, when emitting the first response early
+                var wg sync.WaitGroup
+                state := t.newTraceState()
+
+                // Poller shared by the hops probed one after the
+                // other, which is created along with the first hop
+                var poll *poller
+                defer func() {
+                        if poll != nil {
+                                poll.close()
+                        }
+                }()
+
         L:
-                for {
+                for _, ttl := range ttls {
                         select {
                         case <-ctx.Done():
+                                if interrupted != nil {
+                                        interrupted.Store(true)
+                                }
                                 break L
                         default:
                                 // Emit probes
-                                ttl += 1
-                                probes, err := t.sendProbes(dest, ttl)
-                                if err != nil {
-                                        ch <- Probe{Error: err}
-                                        break L
+                                responded := false
+                                if t.opts.EmitFirstResponse {
+                                        first := make(chan Probe, 1)
+                                        wg.Add(1)
+                                        go t.sendProbesBackground(dest, ttl, &wg, first, ch, state)
+                                        probe := <-first
+                                        if probe.Error != nil {
+                                                break L
+                                        }
+                                        responded = probe.Responded()
+                                } else {
+                                        if poll == nil {
+                                                p, err := t.newPoller(ttl)
+                                                if err != nil {
+                                                        ch <- Probe{Error: err}
+                                                        break L
+                                                }
+                                                poll = p
+                                        }
+                                        err := t.sendProbes(dest, ttl, poll, func(probe Probe) {
+                                                state.observe(&probe)
+                                                t.deliver(ch, probe)
+                                                if probe.Responded() {
+                                                        responded = true
+                                                }
+                                        })
+                                        if err != nil {
+                                                ch <- Probe{Error: err}
+                                                break L
+                                        }
                                 }
 
-                                // Send probe results
-                                destReached := false
-                                for _, probe := range probes {
-                                        ch <- probe
-                                        if probe.Hop.Equal(dest) {
-                                                destReached = true
-                                        }
+                                if ttl == 1 && !responded && t.opts.FailFastOnFirstHop {
+                                        ch <- Probe{Error: ErrFirstHopUnreachable}
+                                        break L
                                 }
 
                                 // Are we there yet?
-                                if destReached || ttl >= t.opts.MaxHops {
+                                if (state.reached.Load() && stopOnReach) || state.done() {
                                         break L
                                 }
                         }
                 }
-                close(ch)
+                wg.Wait()
+                closeCh()
         }
 
         go prober()
         return ch
 }
 
-// Sends the probes to the destination with the given TTL.
-func (t *Tracer) sendProbes(dest net.IP, ttl int) ([]Probe, error) {
+// Sends the probes to the destination with the given TTL to the
+// results channel. Once the first responding probe of the hop has been
+// sent, it is also passed to the first channel, so that the caller can
+// continue with the next hop. The probes sent afterwards are marked as
+// refinements. If none of the probes responded, the first channel
+// receives the first probe of the hop after all probes completed. If
+// no probes were sent at all, it receives a star probe of the hop,
+// which is not delivered to the trace.
+func (t *Tracer) sendProbesBackground(dest net.IP, ttl int, wg *sync.WaitGroup, first, ch chan<- Probe, state *traceState) {
+        defer wg.Done()
+
+        signaled := false
+        pending := make([]Probe, 0)
+        signal := func(probe Probe) {
+                t.deliver(ch, probe)
+                first <- probe
+                signaled = true
+                for _, p := range pending {
+                        p.Refinement = true
+                        t.deliver(ch, p)
+                }
+                pending = nil
+        }
+
+        err := t.sendProbes(dest, ttl, nil, func(probe Probe) {
+                state.observe(&probe)
+                switch {
+                case signaled:
+                        probe.Refinement = true
+                        t.deliver(ch, probe)
+                case probe.Responded():
+                        signal(probe)
+                default:
+                        pending = append(pending, probe)
+                }
+        })
+
+        if !signaled && len(pending) > 0 {
+                probe := pending[0]
+                pending = pending[1:]
+                signal(probe)
+        }
+        if err == nil {
+                if !signaled {
+                        first <- Probe{TTL: ttl, Hop: net.IPv4zero}
+                }
+                return
+        }
+        if !signaled {
+                signal(Probe{Error: err})
+                return
+        }
+        state.failed.Store(true)
+        ch <- Probe{Error: err}
+}
+
+// State of a trace, which is shared with the hops probed in the
+// background
+type traceState struct {
+        reached, failed, exceeded, looped atomic.Bool
+
+        // Detects routing loops, or nil if Options.DetectLoops is not
+        // set
+        loops *loopDetector
+}
+
+// Creates the state of a new trace.
+func (t *Tracer) newTraceState() *traceState {
+        s := &traceState{}
+        if t.opts.DetectLoops {
+                s.loops = newLoopDetector(t.opts.LoopThreshold)
+        }
+
+        return s
+}
+
+// Records the outcome of a probe of the trace, and marks the probe if
+// it revealed a routing loop.
+func (s *traceState) observe(probe *Probe) {
+        if probe.Reached {
+                s.reached.Store(true)
+        }
+        if probe.RTTExceeded {
+                s.exceeded.Store(true)
+        }
+        if s.loops != nil && s.loops.add(*probe) {
+                probe.Looped = true
+                s.looped.Store(true)
+        }
+}
+
+// Returns whether the trace has to stop for any other reason than
+// having reached the destination.
+func (s *traceState) done() bool {
+        return s.failed.Load() || s.exceeded.Load() || s.looped.Load()
+}
+
+// Sends the probe to the results channel, unless it is a probe without
+// a response and Options.SuppressStars is set.
+func (t *Tracer) deliver(ch chan<- Probe, probe Probe) {
+        if t.opts.SuppressStars && probe.Error == nil && !probe.Responded() {
+                return
+        }
+
+        ch <- probe
+}
+
+// Sends the probes to the destination with the given TTL. Each probe
+// is passed to emit, as soon as it completes. The replies are awaited
+// via the given poller, or via one created for the hop, if nil.
+func (t *Tracer) sendProbes(dest net.IP, ttl int, poll *poller, emit func(Probe)) error {
         var dstAddr4 [4]byte
         copy(dstAddr4[:], dest.To4())
         soAddr4 := &syscall.SockaddrInet4{
@@ -178,106 +1270,275 @@ func (t *Tracer) sendProbes(dest net.IP, ttl int) ([]Probe, error) {
                 Addr: dstAddr4,
         }
 
-        fd, err := t.createSocket(ttl)
-        if err != nil {
-                return nil, err
+        if poll == nil {
+                var err error
+                poll, err = t.newPoller(ttl)
+                if err != nil {
+                        return err
+                }
+                defer poll.close()
         }
-        defer syscall.Close(fd)
 
-        epollFd, err := syscall.EpollCreate(1)
+        conn, err := t.openConn(poll, ttl, t.nextSourcePort())
         if err != nil {
-                return nil, err
-        }
-        defer syscall.Close(epollFd)
-
-        var epollEvent syscall.EpollEvent
-        if err := syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_ADD, fd, &epollEvent); err != nil {
-                return nil, err
+                return err
         }
+        defer func() {
+                conn.close()
+        }()
 
-        probes := make([]Probe, 0)
-        for i := 0; i < int(t.opts.NumProbes); i++ {
-                start := time.Now()
-                b := make([]byte, t.opts.PacketLength)
-                if err != nil {
-                        return nil, err
+        // Send a throwaway probe to the first hop, so that ARP or
+        // neighbor discovery is not accounted to the first measured RTT
+        if ttl == 1 && t.opts.WarmupFirstHop {
+                if _, err := t.sendProbe(conn, soAddr4, ttl, 0, t.opts.ProbeMaxWaitDuration, 0); err != nil {
+                        return err
                 }
+        }
 
-                if err := syscall.Sendto(fd, b, 0, soAddr4); err != nil {
-                        return nil, err
+        names := make(map[string]hopName)
+        discovered := false
+        destWait := t.opts.DestProbeTimeout
+        hopStart := t.now()
+        responses := 0
+        for i := 0; i < t.hopProbes(i, responses); i++ {
+                if i < len(t.opts.ProbeSendOffsets) {
+                        if wait := time.Until(hopStart.Add(t.opts.ProbeSendOffsets[i])); wait > 0 {
+                                time.Sleep(wait)
+                        }
                 }
 
-                // https://datatracker.ietf.org/doc/html/rfc1812
-                p := make([]byte, 1500)
-                oob := make([]byte, 1500)
-                hopIp := net.IPv4zero
-                var probeError error
-                for {
-                        now := time.Now()
-                        timeout := now.Add(t.opts.ProbeMaxWaitDuration).Sub(now).Nanoseconds() / int64(time.Millisecond)
-                        syscall.EpollWait(epollFd, []syscall.EpollEvent{epollEvent}, int(timeout))
-                        _, _, _, _, err := syscall.Recvmsg(fd, p, oob, syscall.MSG_ERRQUEUE)
+                // Each probe of a source port sweep needs its own socket
+                if i > 0 && t.opts.SourcePortMin > 0 && t.opts.SourcePortMax > 0 {
+                        conn.close()
+                        conn, err = t.openConn(poll, ttl, t.nextSourcePort())
                         if err != nil {
-                                break
+                                return err
                         }
+                }
 
-                        cMsgHdr := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
-                        if cMsgHdr.Level != syscall.IPPROTO_IP {
-                                continue
+                to := soAddr4
+                if t.opts.DistinctPorts {
+                        to = &syscall.SockaddrInet4{
+                                Port: probePort(soAddr4.Port, i),
+                                Addr: soAddr4.Addr,
                         }
-
-                        se := (*SockExtendedErr)(unsafe.Pointer(&oob[syscall.SizeofCmsghdr]))
-                        if se.Origin != uint8(SockExtendedErrorOriginICMP) {
-                                continue
+                }
+                probe, err := t.sendProbe(conn, to, ttl, i, t.opts.ProbeMaxWaitDuration, destWait)
+                if err != nil {
+                        return err
+                }
+                probe.SendOffset = probe.Start.Sub(hopStart)
+                probe.SourcePort = conn.localPort()
+                probe.ReverseHopEstimate = reverseHops(probe.ReplyTTL)
+                if t.opts.ResolveNames && probe.Responded() {
+                        name, ok := names[probe.Hop.String()]
+                        if !ok {
+                                name = t.resolveName(probe.Hop)
+                                names[probe.Hop.String()] = name
                         }
-
-                        switch cMsgHdr.Type {
-                        case int32(ipv4.ICMPTypeTimeExceeded), int32(ipv4.ICMPTypeDestinationUnreachable):
-                                src := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&oob[syscall.SizeofCmsghdr+int(unsafe.Sizeof(*se))]))
-                                hopIp = net.IP([]byte(src.Addr[:]))
+                        probe.Name = name.name
+                        probe.ForwardAddrs = name.forward
+                        probe.DNSMismatch = name.mismatch
+                }
+                if !discovered && probe.Responded() {
+                        discovered = true
+                        if t.opts.OnHopDiscovered != nil {
+                                t.opts.OnHopDiscovered(HopDiscovered{TTL: ttl, IP: probe.Hop})
                         }
-                        break
+                }
+                if probe.Responded() {
+                        responses++
                 }
 
-                end := time.Now()
-                probe := Probe{
-                        Start: start,
-                        End:   end,
-                        Hop:   hopIp,
-                        TTL:   ttl,
-                        Error: probeError,
+                // A router answered in place of the destination, which
+                // is therefore not reached with this TTL
+                if probe.Responded() && !probe.Reached {
+                        destWait = 0
+                }
+                emit(probe)
+                if t.opts.FailFast && !probe.Responded() {
+                        return fmt.Errorf("probe %d with TTL %d: %w", i, ttl, ErrProbeLost)
                 }
-                probes = append(probes, probe)
         }
 
-        return probes, nil
+        return nil
 }
 
-// Creates a socket with the given TTL.
-func (t *Tracer) createSocket(ttl int) (int, error) {
-        fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
-        if err != nil {
-                return fd, err
+// Returns the destination port of the probe with the given index,
+// when each probe of a hop is sent to a different port. The ports
+// wrap around to 1 past 65535, since port 0 is not valid.
+func probePort(port, i int) int {
+        return (port-1+i)%65535 + 1
+}
+
+// Returns how long a probe waits for a response, which is destWait
+// for a response of the destination, if longer than wait.
+func replyWait(wait, destWait time.Duration) time.Duration {
+        if destWait > wait {
+                return destWait
         }
 
-        timeout := syscall.NsecToTimeval(int64(t.opts.ProbeMaxWaitDuration * 1000 * 1000 * 1000))
-        if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
-                return fd, err
+        return wait
+}
+
+// Returns whether a response, which arrived the given time after its
+// probe was sent, is accepted. Any response is accepted within wait,
+// but only the ones of the destination after that.
+func acceptReply(elapsed, wait, destWait time.Duration, reached bool) bool {
+        if elapsed <= wait {
+                return true
         }
 
-        if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-                return fd, err
+        return reached && elapsed <= replyWait(wait, destWait)
+}
+
+// Returns the number of probes of a hop, which has answered the given
+// number of the probes sent so far. Without AdaptiveProbes this is
+// always NumProbes.
+func (t *Tracer) hopProbes(sent, responses int) int {
+        numProbes := int(t.opts.NumProbes)
+        if !t.opts.AdaptiveProbes {
+                return numProbes
         }
 
-        if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TTL, ttl); err != nil {
-                return fd, err
+        switch {
+        case sent < numProbes && sent >= t.minAdaptiveProbes() && responses == sent:
+                return sent
+        case sent >= numProbes && responses > 0 && responses < sent:
+                if max := t.maxAdaptiveProbes(); max > numProbes {
+                        return max
+                }
         }
 
-        // Set IP_RECVERR here, so that we can receive the ICMP
-        // control messages in the error queue
-        if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVERR, 1); err != nil {
-                return fd, err
+        return numProbes
+}
+
+// Returns the number of probes, which confirm a hop as clean in
+// adaptive mode.
+func (t *Tracer) minAdaptiveProbes() int {
+        if t.opts.MinAdaptiveProbes == 0 {
+                return (int(t.opts.NumProbes) + 1) / 2
+        }
+
+        return int(t.opts.MinAdaptiveProbes)
+}
+
+// Returns the maximum number of probes per hop in adaptive mode.
+func (t *Tracer) maxAdaptiveProbes() int {
+        if t.opts.MaxAdaptiveProbes == 0 {
+                return 2 * int(t.opts.NumProbes)
+        }
+
+        return int(t.opts.MaxAdaptiveProbes)
+}
+
+// Reports a wait for a reply, which started at the given time, to
+// Options.TimingHook.
+func (t *Tracer) reportWait(ttl, seq int, sent time.Time, timeout time.Duration, begin time.Time, n int, err error) {
+        outcome := WaitReady
+        switch {
+        case err != nil:
+                outcome = WaitFailed
+        case n == 0:
+                outcome = WaitTimeout
+        }
+
+        t.opts.TimingHook(TimingEvent{
+                TTL:        ttl,
+                ProbeIndex: seq,
+                Sent:       sent,
+                Timeout:    timeout,
+                Blocked:    time.Since(begin),
+                Outcome:    outcome,
+        })
+}
+
+// Flags the probe as implausible when its reply arrived faster than
+// Options.MinPlausibleRTT, and as exceeding the latency budget when it
+// arrived slower than Options.MaxAcceptableRTT.
+func (t *Tracer) checkRTT(probe *Probe) {
+        if !probe.Responded() {
+                return
+        }
+        if t.opts.MinPlausibleRTT > 0 {
+                probe.Implausible = probe.RTT() < t.opts.MinPlausibleRTT
+        }
+        if t.opts.MaxAcceptableRTT > 0 {
+                probe.RTTExceeded = probe.RTT() > t.opts.MaxAcceptableRTT
+        }
+}
+
+// Returns the next source port of the sweep over Options.SourcePortMin
+// to Options.SourcePortMax, or zero if no sweep is configured.
+func (t *Tracer) nextSourcePort() int {
+        if t.opts.SourcePortMin == 0 || t.opts.SourcePortMax < t.opts.SourcePortMin {
+                return 0
+        }
+
+        t.mu.Lock()
+        defer t.mu.Unlock()
+
+        n := int(t.opts.SourcePortMax) - int(t.opts.SourcePortMin) + 1
+        port := int(t.opts.SourcePortMin) + t.portSeq%n
+        t.portSeq++
+
+        return port
+}
+
+// Returns a SetupError for the given phase.
+func (t *Tracer) setupError(phase string, ttl int, err error) error {
+        return &SetupError{
+                Phase:   phase,
+                TTL:     ttl,
+                Options: t.Options(),
+                Err:     err,
+        }
+}
+
+// Fills the given buffer with random bytes
+func (t *Tracer) randRead(b []byte) {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+        t.rng.Read(b)
+}
+
+// Returns the name of the given address via a reverse DNS lookup, or
+// an empty string if the lookup fails.
+func lookupName(ip net.IP) string {
+        names, err := net.LookupAddr(ip.String())
+        if err != nil || len(names) == 0 {
+                return ""
+        }
+
+        return strings.TrimSuffix(names[0], ".")
+}
+
+// The resolved name of a hop
+type hopName struct {
+        // Reverse name of the hop
+        name string
+
+        // Addresses of the name, and whether the hop is not among them
+        forward  []net.IP
+        mismatch bool
+}
+
+// Resolves the name of the hop, and verifies it via a forward lookup
+// if Options.VerifyNames is set.
+func (t *Tracer) resolveName(ip net.IP) hopName {
+        name := hopName{name: lookupName(ip)}
+        if !t.opts.VerifyNames || name.name == "" {
+                return name
+        }
+
+        name.forward, _ = net.LookupIP(name.name)
+        name.mismatch = true
+        for _, addr := range name.forward {
+                if addr.Equal(ip) {
+                        name.mismatch = false
+                        break
+                }
         }
 
-        return fd, nil
+        return name
 }
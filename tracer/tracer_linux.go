@@ -0,0 +1,536 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "errors"
+        "fmt"
+        "net"
+        "runtime"
+        "syscall"
+        "time"
+        "unsafe"
+
+        "golang.org/x/net/ipv4"
+        "golang.org/x/sys/unix"
+)
+
+// ICMP code of a port unreachable error, see RFC 792
+const icmpCodePortUnreachable = 3
+
+// Sends a single probe to the destination and waits up to the given
+// duration for the reply, or up to destWait for a reply of the
+// destination.
+func (t *Tracer) sendProbe(c *probeConn, to *syscall.SockaddrInet4, ttl, seq int, wait, destWait time.Duration) (Probe, error) {
+        b, err := t.encoder.Encode(ttl, seq)
+        if err != nil {
+                return Probe{}, fmt.Errorf("unable to encode probe with TTL %d: %w", ttl, err)
+        }
+
+        start := t.now()
+        if err := sendTo(c.fd, b, to); err != nil {
+                return Probe{}, sendError(ttl, err)
+        }
+
+        // https://datatracker.ietf.org/doc/html/rfc1812
+        p := make([]byte, 1500)
+        oob := make([]byte, 1500)
+        events := make([]syscall.EpollEvent, 1)
+        probe := Probe{
+                Start:     start,
+                Hop:       net.IPv4zero,
+                TTL:       ttl,
+                SentBytes: len(b),
+                Port:      uint16(to.Port),
+        }
+        var sent, received icmpReply
+        deadline := start.Add(replyWait(wait, destWait))
+        for {
+                now := t.now()
+                timeout := deadline.Sub(now).Milliseconds()
+                if timeout < 0 {
+                        timeout = 0
+                }
+                n, err := syscall.EpollWait(c.poller.fd, events, int(timeout))
+                if t.opts.TimingHook != nil {
+                        t.reportWait(ttl, seq, start, time.Duration(timeout)*time.Millisecond, now, n, err)
+                }
+                reply, ok, err := readReply(c.fd, p, oob, syscall.MSG_ERRQUEUE)
+                if err != nil {
+                        break
+                }
+                if reply.noRoute != nil {
+                        return Probe{}, sendError(ttl, reply.noRoute)
+                }
+                if reply.txStamp {
+                        // Software and hardware timestamps of a sent
+                        // probe are delivered separately
+                        if reply.ifIndex != 0 {
+                                sent.ifIndex = reply.ifIndex
+                        }
+                        if !reply.softStamp.IsZero() {
+                                sent.softStamp = reply.softStamp
+                        }
+                        if !reply.hardStamp.IsZero() {
+                                sent.hardStamp = reply.hardStamp
+                        }
+                        continue
+                }
+                if !ok || !t.encoder.Match(b, reply.payload) {
+                        continue
+                }
+                // Past wait only the destination may still respond
+                replied := probe
+                t.applyReply(&replied, reply, to)
+                if !acceptReply(t.now().Sub(start), wait, destWait, replied.Reached) {
+                        continue
+                }
+                probe = replied
+                received = reply
+                break
+        }
+        probe.End = t.now()
+        probe.InterfaceIndex = sent.ifIndex
+        t.applyClock(&probe, sent, received)
+        t.checkRTT(&probe)
+        if t.opts.RandomizePayload || t.opts.UniquePayloadPerProbe || t.opts.Encoder != nil {
+                probe.Payload = b
+        }
+
+        return probe, nil
+}
+
+// An ICMP error read from the error queue of a probe socket
+type icmpReply struct {
+        // Type and code of the ICMP error
+        icmpType ipv4.ICMPType
+        code     uint8
+
+        // Address of the hop, which sent the error
+        offender net.IP
+
+        // Destination of the quoted datagram
+        quoted *syscall.SockaddrInet4
+
+        // Quoted payload of the datagram and the raw control messages
+        payload []byte
+        oob     []byte
+
+        // Index of the interface reported by IP_PKTINFO, which is the
+        // interface a probe left from for its transmit timestamp
+        ifIndex int
+
+        // TTL of the IP packet carrying the error
+        ttl int
+
+        // Software and hardware timestamps of the message, if any
+        softStamp time.Time
+        hardStamp time.Time
+
+        // txStamp is true, if the message is the timestamp of a sent
+        // probe, rather than an ICMP error
+        txStamp bool
+
+        // noRoute is the ENETUNREACH or EHOSTUNREACH error of a failed
+        // send, which was queued by the local stack rather than reported
+        // by a hop
+        noRoute error
+}
+
+// Reads the next message from the error queue of the socket into the
+// given buffers. Returns false, if the message is not an ICMP error.
+func readReply(fd int, p, oob []byte, flags int) (icmpReply, bool, error) {
+        n, oobn, _, from, err := syscall.Recvmsg(fd, p, oob, flags)
+        if err != nil {
+                return icmpReply{}, false, err
+        }
+        reply, ok := parseReply(p[:n], oob[:oobn], from)
+
+        return reply, ok, nil
+}
+
+// Parses a message read from the error queue of a probe socket, which
+// consists of the payload, the control messages and the address the
+// message was read from. Returns false, if the message is not an ICMP
+// error.
+func parseReply(payload, oob []byte, from syscall.Sockaddr) (icmpReply, bool) {
+        // Besides the extended error, the kernel may place other
+        // control messages like IP_PKTINFO in front of it, so walk
+        // through all of them.
+        msgs, err := syscall.ParseSocketControlMessage(oob)
+        if err != nil {
+                return icmpReply{}, false
+        }
+        reply := icmpReply{
+                payload: payload,
+                oob:     oob,
+        }
+        var se *SockExtendedErr
+        for _, m := range msgs {
+                if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPING {
+                        if len(m.Data) < int(unsafe.Sizeof(unix.ScmTimestamping{})) {
+                                continue
+                        }
+                        ts := (*unix.ScmTimestamping)(unsafe.Pointer(&m.Data[0]))
+                        if ts.Ts[0].Sec != 0 || ts.Ts[0].Nsec != 0 {
+                                reply.softStamp = time.Unix(ts.Ts[0].Unix())
+                        }
+                        if ts.Ts[2].Sec != 0 || ts.Ts[2].Nsec != 0 {
+                                reply.hardStamp = time.Unix(ts.Ts[2].Unix())
+                        }
+                        continue
+                }
+                if m.Header.Level != syscall.IPPROTO_IP {
+                        continue
+                }
+                switch m.Header.Type {
+                case syscall.IP_RECVERR:
+                        if len(m.Data) < int(unsafe.Sizeof(SockExtendedErr{})+syscall.SizeofSockaddrInet4) {
+                                continue
+                        }
+                        se = (*SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+                        offender := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&m.Data[unsafe.Sizeof(*se)]))
+                        reply.offender = append(net.IP(nil), offender.Addr[:]...)
+                case syscall.IP_TTL:
+                        if len(m.Data) >= 4 {
+                                reply.ttl = int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+                        }
+                case syscall.IP_PKTINFO:
+                        if len(m.Data) < syscall.SizeofInet4Pktinfo {
+                                continue
+                        }
+                        info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+                        reply.ifIndex = int(info.Ifindex)
+                }
+        }
+        if se != nil && se.Origin == uint8(SockExtendedErrorOriginLocal) {
+                if errno := syscall.Errno(se.Errno); errno == syscall.ENETUNREACH || errno == syscall.EHOSTUNREACH {
+                        reply.noRoute = errno
+                }
+                return reply, false
+        }
+        if se != nil && se.Origin == uint8(SockExtendedErrorOriginTimestamp) {
+                reply.txStamp = true
+                return reply, false
+        }
+        if se == nil || se.Origin != uint8(SockExtendedErrorOriginICMP) {
+                return icmpReply{}, false
+        }
+        reply.icmpType = ipv4.ICMPType(se.Type)
+        reply.code = se.Code
+        if quoted, ok := from.(*syscall.SockaddrInet4); ok {
+                reply.quoted = quoted
+        }
+
+        return reply, true
+}
+
+// Sends the probe to the destination. With IP_RECVERR set, the socket
+// records the ICMP error of an earlier probe, e.g. a late port
+// unreachable error of the destination, as its pending error. The next
+// send fails with that error without sending the probe, but clears it,
+// so the send is retried once.
+func sendTo(fd int, b []byte, to *syscall.SockaddrInet4) error {
+        if err := syscall.Sendto(fd, b, 0, to); err == nil {
+                return nil
+        }
+
+        return syscall.Sendto(fd, b, 0, to)
+}
+
+// Returns the error of a failed send of a probe with the given TTL,
+// which wraps ErrNoRoute if the destination is unreachable from here.
+func sendError(ttl int, err error) error {
+        if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+                return fmt.Errorf("%w: %w", ErrNoRoute, err)
+        }
+
+        return fmt.Errorf("unable to send probe with TTL %d: %w", ttl, err)
+}
+
+// Records the given reply to a probe sent to the given destination.
+func (t *Tracer) applyReply(probe *Probe, reply icmpReply, to *syscall.SockaddrInet4) {
+        probe.ReplyBytes = len(reply.payload)
+        probe.ReplyTTL = reply.ttl
+        for _, parser := range t.opts.ReplyParsers {
+                if ext := parser.Parse(reply.payload, reply.oob); ext != nil {
+                        probe.Extensions = append(probe.Extensions, ext)
+                }
+        }
+        if reply.quoted != nil {
+                probe.QuotedDestination = net.IP([]byte(reply.quoted.Addr[:]))
+        }
+
+        switch reply.icmpType {
+        case ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeDestinationUnreachable:
+                probe.Hop = reply.offender
+        }
+
+        // A port unreachable error can only be generated by the
+        // destination itself. The error queue provides the destination
+        // of the quoted datagram, which lets us recognize the
+        // destination even if it replies from a different address,
+        // e.g. behind NAT or anycast.
+        if reply.icmpType == ipv4.ICMPTypeDestinationUnreachable && reply.code == icmpCodePortUnreachable {
+                if reply.quoted != nil && reply.quoted.Addr == to.Addr && reply.quoted.Port == to.Port {
+                        probe.Reached = true
+                }
+        }
+
+        if probe.Hop.Equal(net.IP(to.Addr[:])) {
+                probe.Reached = true
+        } else if probe.Reached {
+                probe.RepliedFrom = probe.Hop
+        }
+}
+
+// Replaces the timestamps of the probe with the ones provided by the
+// kernel for the sent probe and its reply, according to the clock
+// source.
+func (t *Tracer) applyClock(probe *Probe, sent, received icmpReply) {
+        switch {
+        case t.opts.ClockSource == ClockHardware && !sent.hardStamp.IsZero() && !received.hardStamp.IsZero():
+                probe.Start, probe.End = sent.hardStamp, received.hardStamp
+                probe.ClockSource = ClockHardware
+        case t.opts.ClockSource != ClockMonotonic && !sent.softStamp.IsZero() && !received.softStamp.IsZero():
+                probe.Start, probe.End = sent.softStamp, received.softStamp
+                probe.ClockSource = ClockKernel
+        }
+}
+
+// Traces use the error queue of UDP sockets
+const traceMethod = MethodUDPRecvErr
+
+// Epoll instance for waiting on the error queues of the probe sockets
+type poller struct {
+        fd int
+}
+
+// Creates a new poller.
+func (t *Tracer) newPoller(ttl int) (*poller, error) {
+        fd, err := syscall.EpollCreate(1)
+        if err != nil {
+                return nil, t.setupError("epoll", ttl, err)
+        }
+
+        return &poller{fd: fd}, nil
+}
+
+// Closes the epoll instance.
+func (p *poller) close() {
+        syscall.Close(p.fd)
+}
+
+// Probe socket, which is registered with a poller. Since the poller
+// may be shared by the sockets of subsequent hops, each socket has to
+// be closed once done.
+type probeConn struct {
+        fd     int
+        poller *poller
+}
+
+// Creates a probe socket with the given TTL and source port, and adds
+// it to the poller.
+func (t *Tracer) openConn(p *poller, ttl, srcPort int) (*probeConn, error) {
+        fd, err := t.createSocket(ttl, srcPort)
+        if err != nil {
+                return nil, err
+        }
+
+        var epollEvent syscall.EpollEvent
+        if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &epollEvent); err != nil {
+                syscall.Close(fd)
+                return nil, t.setupError("epoll", ttl, err)
+        }
+
+        return &probeConn{fd: fd, poller: p}, nil
+}
+
+// Removes the probe socket from its poller and closes it, so that none
+// of its pending errors is reported for the next socket.
+func (c *probeConn) close() {
+        syscall.EpollCtl(c.poller.fd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+        syscall.Close(c.fd)
+}
+
+// Returns the local port of the socket, or zero if it is not bound.
+func (c *probeConn) localPort() uint16 {
+        sa, err := syscall.Getsockname(c.fd)
+        if err != nil {
+                return 0
+        }
+        if addr, ok := sa.(*syscall.SockaddrInet4); ok {
+                return uint16(addr.Port)
+        }
+
+        return 0
+}
+
+// Creates a probe socket with the given TTL and source port, and an
+// epoll instance for waiting on its error queue.
+func (t *Tracer) openSocket(ttl, srcPort int) (int, int, error) {
+        p, err := t.newPoller(ttl)
+        if err != nil {
+                return -1, -1, err
+        }
+
+        c, err := t.openConn(p, ttl, srcPort)
+        if err != nil {
+                p.close()
+                return -1, -1, err
+        }
+
+        return c.fd, p.fd, nil
+}
+
+// Creates a socket with the given TTL, which is bound to the given
+// source port, unless zero.
+func (t *Tracer) createSocket(ttl, srcPort int) (int, error) {
+        fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+        if err != nil {
+                return -1, t.setupError("socket", ttl, err)
+        }
+
+        // Closes the socket, which failed to be set up in the given phase
+        fail := func(phase string, err error) (int, error) {
+                syscall.Close(fd)
+                return -1, t.setupError(phase, ttl, err)
+        }
+
+        timeout := syscall.NsecToTimeval(int64(t.opts.ProbeMaxWaitDuration * 1000 * 1000 * 1000))
+        if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+                return fail("setsockopt SO_RCVTIMEO", err)
+        }
+
+        if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+                return fail("setsockopt SO_REUSEADDR", err)
+        }
+
+        if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TTL, ttl); err != nil {
+                return fail("setsockopt IP_TTL", err)
+        }
+
+        if t.opts.SocketPriority > 0 {
+                if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PRIORITY, t.opts.SocketPriority); err != nil {
+                        if errors.Is(err, syscall.EPERM) {
+                                return fail("setsockopt SO_PRIORITY", fmt.Errorf("priorities above 6 require CAP_NET_ADMIN: %w", err))
+                        }
+                        return fail("setsockopt SO_PRIORITY", err)
+                }
+        }
+
+        if t.opts.Mark > 0 {
+                if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(t.opts.Mark)); err != nil {
+                        if errors.Is(err, syscall.EPERM) {
+                                return fail("setsockopt SO_MARK", fmt.Errorf("missing CAP_NET_ADMIN: %w", err))
+                        }
+                        return fail("setsockopt SO_MARK", err)
+                }
+        }
+
+        if t.opts.SendBufferSize > 0 {
+                if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, t.opts.SendBufferSize); err != nil {
+                        return fail("setsockopt SO_SNDBUF", err)
+                }
+        }
+
+        if t.opts.RouterAlert {
+                if err := syscall.SetsockoptString(fd, syscall.SOL_IP, syscall.IP_OPTIONS, string(routerAlertOption)); err != nil {
+                        return fail("setsockopt IP_OPTIONS", err)
+                }
+        }
+
+        // Set IP_RECVERR here, so that we can receive the ICMP
+        // control messages in the error queue
+        if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVERR, 1); err != nil {
+                return fail("setsockopt IP_RECVERR", err)
+        }
+
+        // Timestamping is best-effort, since the probes fall back to
+        // the monotonic clock without the timestamps. The transmit
+        // timestamps are always requested, since with OPT_CMSG they
+        // carry the IP_PKTINFO of the interface the probe left from.
+        // OPT_TSONLY would drop it, because the kernel needs the sent
+        // packet to report the interface.
+        stampFlags := unix.SOF_TIMESTAMPING_TX_SOFTWARE | unix.SOF_TIMESTAMPING_OPT_CMSG
+        switch t.opts.ClockSource {
+        case ClockKernel:
+                stampFlags |= unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE
+        case ClockHardware:
+                stampFlags |= unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE |
+                        unix.SOF_TIMESTAMPING_TX_HARDWARE | unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+        }
+        syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_TIMESTAMPING, stampFlags)
+
+        // Set IP_RECVTTL to learn the remaining TTL of the ICMP
+        // replies
+        if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVTTL, 1); err != nil {
+                return fail("setsockopt IP_RECVTTL", err)
+        }
+
+        // Set IP_PKTINFO to learn the interface the probes leave from
+        if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_PKTINFO, 1); err != nil {
+                return fail("setsockopt IP_PKTINFO", err)
+        }
+
+        if t.opts.FreeBind {
+                if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_FREEBIND, 1); err != nil {
+                        if errors.Is(err, syscall.EPERM) {
+                                return fail("setsockopt IP_FREEBIND", fmt.Errorf("missing CAP_NET_ADMIN: %w", err))
+                        }
+                        return fail("setsockopt IP_FREEBIND", err)
+                }
+        }
+
+        if t.opts.SourceAddr != nil || srcPort != 0 {
+                var srcAddr4 [4]byte
+                copy(srcAddr4[:], t.opts.SourceAddr.To4())
+                src := &syscall.SockaddrInet4{Port: srcPort, Addr: srcAddr4}
+                if err := syscall.Bind(fd, src); err != nil {
+                        return fail("bind", fmt.Errorf("%s:%d: %w", net.IP(srcAddr4[:]), srcPort, err))
+                }
+        }
+
+        return fd, nil
+}
+
+// Locks the calling goroutine to its OS thread and pins the thread to
+// the given CPU. The thread is intentionally never unlocked, so that
+// the runtime terminates it once the goroutine exits, instead of
+// reusing a thread with a modified affinity.
+func pinCPU(cpu int) error {
+        runtime.LockOSThread()
+
+        var set unix.CPUSet
+        set.Zero()
+        set.Set(cpu)
+
+        if err := unix.SchedSetaffinity(0, &set); err != nil {
+                return fmt.Errorf("unable to pin to CPU %d: %w", cpu, err)
+        }
+
+        return nil
+}
@@ -0,0 +1,955 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "bytes"
+        "context"
+        "errors"
+        "fmt"
+        "net"
+        "runtime"
+        "sort"
+        "sync"
+        "syscall"
+        "testing"
+        "time"
+        "unsafe"
+
+        "golang.org/x/net/ipv4"
+        "golang.org/x/sys/unix"
+)
+
+// Returns a control message with the given level, type and data.
+func cmsg(level, typ int32, data []byte) []byte {
+        b := make([]byte, syscall.CmsgSpace(len(data)))
+        h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+        h.Level = level
+        h.Type = typ
+        h.SetLen(syscall.CmsgLen(len(data)))
+        copy(b[syscall.CmsgLen(0):], data)
+
+        return b
+}
+
+// Returns the IP_RECVERR control message of an extended error, which
+// was sent by the given offender.
+func recvErr(se SockExtendedErr, offender net.IP) []byte {
+        var addr syscall.RawSockaddrInet4
+        copy(addr.Addr[:], offender.To4())
+        data := make([]byte, unsafe.Sizeof(se)+syscall.SizeofSockaddrInet4)
+        *(*SockExtendedErr)(unsafe.Pointer(&data[0])) = se
+        *(*syscall.RawSockaddrInet4)(unsafe.Pointer(&data[unsafe.Sizeof(se)])) = addr
+
+        return cmsg(syscall.IPPROTO_IP, syscall.IP_RECVERR, data)
+}
+
+// Returns the IP_PKTINFO control message of the given interface.
+func pktInfo(ifIndex int) []byte {
+        info := syscall.Inet4Pktinfo{Ifindex: int32(ifIndex)}
+        data := (*[syscall.SizeofInet4Pktinfo]byte)(unsafe.Pointer(&info))[:]
+
+        return cmsg(syscall.IPPROTO_IP, syscall.IP_PKTINFO, data)
+}
+
+// Returns the IP_TTL control message of the given TTL.
+func ipTTL(ttl int) []byte {
+        v := int32(ttl)
+
+        return cmsg(syscall.IPPROTO_IP, syscall.IP_TTL, (*[4]byte)(unsafe.Pointer(&v))[:])
+}
+
+func TestParseReply(t *testing.T) {
+        hop := net.IPv4(192, 0, 2, 1)
+        dest := &syscall.SockaddrInet4{Port: 33434, Addr: [4]byte{198, 51, 100, 1}}
+        concat := func(msgs ...[]byte) []byte {
+                var b []byte
+                for _, m := range msgs {
+                        b = append(b, m...)
+                }
+                return b
+        }
+
+        tests := []struct {
+                name    string
+                oob     []byte
+                ok      bool
+                txStamp bool
+                ifIndex int
+                ttl     int
+                hop     net.IP
+                noRoute error
+        }{
+                {
+                        name: "transmit timestamp with pktinfo",
+                        oob: concat(
+                                recvErr(SockExtendedErr{Errno: uint32(syscall.ENOMSG), Origin: uint8(SockExtendedErrorOriginTimestamp)}, net.IPv4zero),
+                                pktInfo(3),
+                        ),
+                        txStamp: true,
+                        ifIndex: 3,
+                },
+                {
+                        name: "pktinfo in front of the timestamp",
+                        oob: concat(
+                                pktInfo(7),
+                                recvErr(SockExtendedErr{Errno: uint32(syscall.ENOMSG), Origin: uint8(SockExtendedErrorOriginTimestamp)}, net.IPv4zero),
+                        ),
+                        txStamp: true,
+                        ifIndex: 7,
+                },
+                {
+                        name: "time exceeded",
+                        oob: concat(
+                                recvErr(SockExtendedErr{Errno: uint32(syscall.EHOSTUNREACH), Origin: uint8(SockExtendedErrorOriginICMP), Type: 11}, hop),
+                                ipTTL(61),
+                        ),
+                        ok:  true,
+                        ttl: 61,
+                        hop: hop,
+                },
+                {
+                        name: "local error",
+                        oob:  recvErr(SockExtendedErr{Errno: uint32(syscall.EMSGSIZE), Origin: uint8(SockExtendedErrorOriginLocal)}, net.IPv4zero),
+                },
+                {
+                        name:    "local network unreachable",
+                        oob:     recvErr(SockExtendedErr{Errno: uint32(syscall.ENETUNREACH), Origin: uint8(SockExtendedErrorOriginLocal)}, net.IPv4zero),
+                        noRoute: syscall.ENETUNREACH,
+                },
+                {
+                        name:    "local host unreachable",
+                        oob:     recvErr(SockExtendedErr{Errno: uint32(syscall.EHOSTUNREACH), Origin: uint8(SockExtendedErrorOriginLocal)}, net.IPv4zero),
+                        noRoute: syscall.EHOSTUNREACH,
+                },
+                {
+                        name: "no extended error",
+                        oob:  pktInfo(3),
+                },
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        reply, ok := parseReply([]byte("payload"), tc.oob, dest)
+                        if ok != tc.ok {
+                                t.Fatalf("got ok %v, want %v", ok, tc.ok)
+                        }
+                        if reply.txStamp != tc.txStamp {
+                                t.Errorf("got txStamp %v, want %v", reply.txStamp, tc.txStamp)
+                        }
+                        if tc.txStamp && reply.ifIndex != tc.ifIndex {
+                                t.Errorf("got interface %d, want %d", reply.ifIndex, tc.ifIndex)
+                        }
+                        if reply.noRoute != tc.noRoute {
+                                t.Errorf("got no route error %v, want %v", reply.noRoute, tc.noRoute)
+                        }
+                        if !tc.ok {
+                                return
+                        }
+                        if reply.ttl != tc.ttl {
+                                t.Errorf("got TTL %d, want %d", reply.ttl, tc.ttl)
+                        }
+                        if !reply.offender.Equal(tc.hop) {
+                                t.Errorf("got offender %v, want %v", reply.offender, tc.hop)
+                        }
+                        if reply.quoted == nil || reply.quoted.Addr != dest.Addr {
+                                t.Errorf("got quoted destination %v, want %v", reply.quoted, dest.Addr)
+                        }
+                })
+        }
+}
+
+func TestApplyReply(t *testing.T) {
+        dest := &syscall.SockaddrInet4{Port: 33434, Addr: [4]byte{198, 51, 100, 1}}
+        router := net.IPv4(192, 0, 2, 1)
+        anycast := net.IPv4(203, 0, 113, 1)
+
+        tests := []struct {
+                name     string
+                icmpType ipv4.ICMPType
+                code     uint8
+                offender net.IP
+                quoted   *syscall.SockaddrInet4
+                reached  bool
+                from     net.IP
+        }{
+                {"destination", ipv4.ICMPTypeDestinationUnreachable, icmpCodePortUnreachable, net.IP(dest.Addr[:]), dest, true, nil},
+                {"destination from another address", ipv4.ICMPTypeDestinationUnreachable, icmpCodePortUnreachable, anycast, dest, true, anycast},
+                {"mismatched quoted port", ipv4.ICMPTypeDestinationUnreachable, icmpCodePortUnreachable, anycast, &syscall.SockaddrInet4{Port: 33435, Addr: dest.Addr}, false, nil},
+                {"mismatched quoted address", ipv4.ICMPTypeDestinationUnreachable, icmpCodePortUnreachable, anycast, &syscall.SockaddrInet4{Port: dest.Port, Addr: [4]byte{198, 51, 100, 2}}, false, nil},
+                {"host unreachable", ipv4.ICMPTypeDestinationUnreachable, 1, anycast, dest, false, nil},
+                {"time exceeded", ipv4.ICMPTypeTimeExceeded, 0, router, dest, false, nil},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        probe := Probe{Hop: net.IPv4zero, TTL: 5}
+                        reply := icmpReply{
+                                icmpType: tc.icmpType,
+                                code:     tc.code,
+                                offender: tc.offender,
+                                quoted:   tc.quoted,
+                                payload:  []byte("payload"),
+                                ttl:      60,
+                        }
+                        New(&Options{}).applyReply(&probe, reply, dest)
+
+                        if !probe.Hop.Equal(tc.offender) {
+                                t.Errorf("got hop %v, want %v", probe.Hop, tc.offender)
+                        }
+                        if probe.Reached != tc.reached {
+                                t.Errorf("got reached %v, want %v", probe.Reached, tc.reached)
+                        }
+                        if !probe.RepliedFrom.Equal(tc.from) {
+                                t.Errorf("got replied from %v, want %v", probe.RepliedFrom, tc.from)
+                        }
+                        if !probe.QuotedDestination.Equal(net.IP(tc.quoted.Addr[:])) {
+                                t.Errorf("got quoted destination %v, want %v", probe.QuotedDestination, net.IP(tc.quoted.Addr[:]))
+                        }
+                        if probe.ReplyBytes != len(reply.payload) || probe.ReplyTTL != 60 {
+                                t.Errorf("got %d bytes with TTL %d, want %d with TTL 60", probe.ReplyBytes, probe.ReplyTTL, len(reply.payload))
+                        }
+                })
+        }
+}
+
+func TestSendError(t *testing.T) {
+        tests := []struct {
+                name    string
+                err     error
+                noRoute bool
+        }{
+                {"network unreachable", syscall.ENETUNREACH, true},
+                {"host unreachable", syscall.EHOSTUNREACH, true},
+                {"wrapped host unreachable", fmt.Errorf("sendto: %w", syscall.EHOSTUNREACH), true},
+                {"message too long", syscall.EMSGSIZE, false},
+                {"permission denied", syscall.EPERM, false},
+                {"connection refused", syscall.ECONNREFUSED, false},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        err := sendError(3, tc.err)
+                        if noRoute := errors.Is(err, ErrNoRoute); noRoute != tc.noRoute {
+                                t.Errorf("got %v matching ErrNoRoute %v, want %v", err, noRoute, tc.noRoute)
+                        }
+                        if !errors.Is(err, tc.err) {
+                                t.Errorf("got %v, want it to wrap %v", err, tc.err)
+                        }
+                })
+        }
+}
+
+func TestTraceEgressInterface(t *testing.T) {
+        lo, err := net.InterfaceByName("lo")
+        if err != nil {
+                t.Skip("no loopback interface")
+        }
+
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              1,
+                NumProbes:            1,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        })
+        probes := 0
+        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                probes++
+                if probe.Error != nil {
+                        t.Fatal(probe.Error)
+                }
+                if probe.InterfaceIndex != lo.Index {
+                        t.Errorf("got interface %d, want %d", probe.InterfaceIndex, lo.Index)
+                }
+        }
+        if probes == 0 {
+                t.Error("no probes")
+        }
+}
+
+func TestSetupError(t *testing.T) {
+        tests := []struct {
+                name  string
+                opts  Options
+                ttl   int
+                phase string
+                err   error
+        }{
+                {"foreign source address", Options{SourceAddr: net.IPv4(192, 0, 2, 10)}, 1, "bind", syscall.EADDRNOTAVAIL},
+                {"local source address", Options{SourceAddr: net.IPv4(127, 0, 0, 1)}, 1, "", nil},
+                {"invalid TTL", Options{}, 256, "setsockopt IP_TTL", syscall.EINVAL},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        opts := tc.opts
+                        opts.DestinationPort = 33434
+                        opts.MaxHops = 1
+                        opts.NumProbes = 1
+                        opts.ProbeMaxWaitDuration = 100 * time.Millisecond
+
+                        var got error
+                        for probe := range New(&opts).TraceTTLs(context.Background(), net.IPv4(127, 0, 0, 1), []int{tc.ttl}) {
+                                if probe.Error != nil {
+                                        got = probe.Error
+                                }
+                        }
+                        if tc.err == nil {
+                                if got != nil {
+                                        t.Fatalf("got error %v, want none", got)
+                                }
+                                return
+                        }
+
+                        var se *SetupError
+                        if !errors.As(got, &se) {
+                                t.Fatalf("got error %v, want a SetupError", got)
+                        }
+                        if se.Phase != tc.phase || se.TTL != tc.ttl {
+                                t.Errorf("got phase %q for TTL %d, want %q for TTL %d", se.Phase, se.TTL, tc.phase, tc.ttl)
+                        }
+                        if !errors.Is(got, tc.err) {
+                                t.Errorf("got error %v, want it to wrap %v", got, tc.err)
+                        }
+                        if !se.Options.SourceAddr.Equal(opts.SourceAddr) {
+                                t.Errorf("got options with source %v, want %v", se.Options.SourceAddr, opts.SourceAddr)
+                        }
+                })
+        }
+}
+
+func TestSetupErrorPrivileges(t *testing.T) {
+        tests := []struct {
+                name  string
+                opts  Options
+                phase string
+        }{
+                {"socket priority", Options{SocketPriority: 7}, "setsockopt SO_PRIORITY"},
+                {"mark", Options{Mark: 1}, "setsockopt SO_MARK"},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        opts := tc.opts
+                        opts.ProbeMaxWaitDuration = 100 * time.Millisecond
+
+                        // Capabilities are per thread, so they are
+                        // dropped on a locked thread, which terminates
+                        // along with its goroutine
+                        errc := make(chan error, 1)
+                        go func() {
+                                runtime.LockOSThread()
+                                hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+                                var data [2]unix.CapUserData
+                                if err := unix.Capget(&hdr, &data[0]); err != nil {
+                                        errc <- err
+                                        return
+                                }
+                                data[0].Effective &^= 1<<unix.CAP_NET_ADMIN | 1<<unix.CAP_NET_RAW
+                                if err := unix.Capset(&hdr, &data[0]); err != nil {
+                                        errc <- err
+                                        return
+                                }
+
+                                fd, epollFd, err := New(&opts).openSocket(1, 0)
+                                if err == nil {
+                                        syscall.Close(fd)
+                                        syscall.Close(epollFd)
+                                }
+                                errc <- err
+                        }()
+                        err := <-errc
+
+                        var se *SetupError
+                        if !errors.As(err, &se) {
+                                t.Fatalf("got error %v, want a SetupError", err)
+                        }
+                        if se.Phase != tc.phase || se.TTL != 1 {
+                                t.Errorf("got phase %q for TTL %d, want %q for TTL 1", se.Phase, se.TTL, tc.phase)
+                        }
+                        if !errors.Is(err, syscall.EPERM) {
+                                t.Errorf("got error %v, want it to wrap %v", err, syscall.EPERM)
+                        }
+                })
+        }
+}
+
+func TestSetupErrorFileLimit(t *testing.T) {
+        tests := []struct {
+                name  string
+                fds   uint64
+                phase string
+        }{
+                {"epoll", 0, "epoll"},
+                {"socket", 1, "socket"},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        var limit syscall.Rlimit
+                        if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+                                t.Fatal(err)
+                        }
+
+                        // The lowest free descriptor is the next one
+                        // allocated, so the limit leaves room for the
+                        // given number of descriptors only
+                        free, err := syscall.Dup(0)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        syscall.Close(free)
+                        lowered := syscall.Rlimit{Cur: uint64(free) + tc.fds, Max: limit.Max}
+                        if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+                                t.Fatal(err)
+                        }
+                        tracer := New(&Options{
+                                DestinationPort:      33434,
+                                MaxHops:              1,
+                                NumProbes:            1,
+                                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                        })
+                        var got error
+                        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                                if probe.Error != nil {
+                                        got = probe.Error
+                                }
+                        }
+                        if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+                                t.Fatal(err)
+                        }
+
+                        var se *SetupError
+                        if !errors.As(got, &se) {
+                                t.Fatalf("got error %v, want a SetupError", got)
+                        }
+                        if se.Phase != tc.phase || se.TTL != 1 {
+                                t.Errorf("got phase %q for TTL %d, want %q for TTL 1", se.Phase, se.TTL, tc.phase)
+                        }
+                        if !errors.Is(got, syscall.EMFILE) {
+                                t.Errorf("got error %v, want it to wrap %v", got, syscall.EMFILE)
+                        }
+                })
+        }
+}
+
+func TestPacketLength(t *testing.T) {
+        tests := []struct {
+                name   string
+                length int
+        }{
+                {"empty", 0},
+                {"single byte", 1},
+                {"default", 52},
+                {"large", 1400},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        tracer := New(&Options{
+                                DestinationPort:      33434,
+                                MaxHops:              1,
+                                NumProbes:            1,
+                                PacketLength:         tc.length,
+                                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                        })
+                        probes := 0
+                        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                                probes++
+                                if probe.Error != nil {
+                                        t.Fatal(probe.Error)
+                                }
+                                if probe.SentBytes != tc.length {
+                                        t.Errorf("sent %d bytes, want %d", probe.SentBytes, tc.length)
+                                }
+
+                                // The local stack limits ICMP errors to 576
+                                // bytes, which leaves 520 bytes of quote
+                                quoted := tc.length
+                                if quoted > 520 {
+                                        quoted = 520
+                                }
+                                if probe.ReplyBytes != quoted {
+                                        t.Errorf("got %d bytes quoted, want %d", probe.ReplyBytes, quoted)
+                                }
+                        }
+                        if probes == 0 {
+                                t.Error("no probes")
+                        }
+                })
+        }
+}
+
+func TestTimingHook(t *testing.T) {
+        var events []TimingEvent
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              1,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                TimingHook: func(e TimingEvent) {
+                        events = append(events, e)
+                },
+        })
+        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                if probe.Error != nil {
+                        t.Fatal(probe.Error)
+                }
+        }
+
+        // Each probe waits at least once, and replies arrive well
+        // within the timeout on the loopback interface
+        waited := make(map[int]bool)
+        for _, e := range events {
+                waited[e.ProbeIndex] = true
+                if e.TTL != 1 || e.Outcome != WaitReady {
+                        t.Errorf("got event %+v, want a ready wait with TTL 1", e)
+                }
+                if e.Timeout > 100*time.Millisecond || e.Blocked > e.Timeout {
+                        t.Errorf("got event %+v, exceeding the timeout", e)
+                }
+        }
+        if len(waited) != 3 {
+                t.Errorf("got waits for probes %v, want 3 probes", waited)
+        }
+}
+
+func TestRouterAlert(t *testing.T) {
+        const port = 33998
+
+        tests := []struct {
+                name    string
+                alert   bool
+                options []byte
+        }{
+                {"without", false, []byte{}},
+                {"with", true, routerAlertOption},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        raw := openCapture(t)
+                        tracer := New(&Options{
+                                DestinationPort:      port,
+                                MaxHops:              1,
+                                NumProbes:            1,
+                                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                                RouterAlert:          tc.alert,
+                        })
+                        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                                if probe.Error != nil {
+                                        t.Fatal(probe.Error)
+                                }
+                        }
+
+                        b, ihl := capturePacket(t, raw, port)
+                        if got := b[20:ihl]; !bytes.Equal(got, tc.options) {
+                                t.Errorf("got IP options %x, want %x", got, tc.options)
+                        }
+                })
+        }
+}
+
+func TestSharedPoller(t *testing.T) {
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        })
+        poll, err := tracer.newPoller(1)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer poll.close()
+
+        // The sockets of the earlier hops must not leave events behind
+        // for the later ones
+        for ttl := 1; ttl <= 5; ttl++ {
+                probes := 0
+                err := tracer.sendProbes(net.IPv4(127, 0, 0, 1), ttl, poll, func(p Probe) {
+                        probes++
+                        if p.TTL != ttl || !p.Reached {
+                                t.Errorf("got probe with TTL %d and reached %v, want TTL %d and reached", p.TTL, p.Reached, ttl)
+                        }
+                })
+                if err != nil {
+                        t.Fatalf("sendProbes: %v", err)
+                }
+                if probes != 3 {
+                        t.Errorf("got %d probes for TTL %d, want 3", probes, ttl)
+                }
+        }
+}
+
+func BenchmarkSendProbes(b *testing.B) {
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                NumProbes:            1,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        })
+        dest := net.IPv4(127, 0, 0, 1)
+        emit := func(Probe) {}
+
+        b.Run("poller per hop", func(b *testing.B) {
+                for i := 0; i < b.N; i++ {
+                        if err := tracer.sendProbes(dest, 1, nil, emit); err != nil {
+                                b.Fatal(err)
+                        }
+                }
+        })
+        b.Run("shared poller", func(b *testing.B) {
+                poll, err := tracer.newPoller(1)
+                if err != nil {
+                        b.Fatal(err)
+                }
+                defer poll.close()
+                for i := 0; i < b.N; i++ {
+                        if err := tracer.sendProbes(dest, 1, poll, emit); err != nil {
+                                b.Fatal(err)
+                        }
+                }
+        })
+}
+
+func TestFailFast(t *testing.T) {
+        // A listener on the destination port swallows the probes, which
+        // therefore do not receive a response
+        conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        port := conn.LocalAddr().(*net.UDPAddr).Port
+
+        tests := []struct {
+                name     string
+                failFast bool
+                suppress bool
+                stars    int
+                lost     bool
+        }{
+                {"disabled", false, false, 6, false},
+                {"enabled", true, false, 1, true},
+                {"enabled without stars", true, true, 0, true},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        tracer := New(&Options{
+                                DestinationPort:      uint16(port),
+                                MaxHops:              2,
+                                NumProbes:            3,
+                                ProbeMaxWaitDuration: 20 * time.Millisecond,
+                                FailFast:             tc.failFast,
+                                SuppressStars:        tc.suppress,
+                        })
+
+                        stars := 0
+                        var last error
+                        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                                if probe.Error != nil {
+                                        last = probe.Error
+                                        continue
+                                }
+                                if last != nil {
+                                        t.Errorf("got probe %+v after the error", probe)
+                                }
+                                if !probe.Responded() {
+                                        stars++
+                                }
+                        }
+                        if stars != tc.stars {
+                                t.Errorf("got %d lost probes, want %d", stars, tc.stars)
+                        }
+                        if lost := errors.Is(last, ErrProbeLost); lost != tc.lost {
+                                t.Errorf("got error %v, want ErrProbeLost %v", last, tc.lost)
+                        }
+                })
+        }
+}
+
+func TestDestProbeTimeout(t *testing.T) {
+        // A listener on the destination port swallows the probes, so
+        // that only the router answers the first probe with TTL 1
+        conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+        answered := false
+        routeProbes(t, port, func(ttl int) net.IP {
+                if ttl != 1 || answered {
+                        return nil
+                }
+                answered = true
+                return loopbackRouter
+        })
+
+        const wait = 50 * time.Millisecond
+        timeouts := make(map[[2]int]time.Duration)
+        tracer := New(&Options{
+                DestinationPort:      port,
+                MaxHops:              2,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: wait,
+                DestProbeTimeout:     5 * wait,
+                TimingHook: func(e TimingEvent) {
+                        key := [2]int{e.TTL, e.ProbeIndex}
+                        if _, ok := timeouts[key]; !ok {
+                                timeouts[key] = e.Timeout
+                        }
+                },
+        })
+        probes := make([]Probe, 0)
+        for probe := range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                if probe.Error != nil {
+                        t.Fatal(probe.Error)
+                }
+                probes = append(probes, probe)
+        }
+        if len(probes) != 6 {
+                t.Fatalf("got %d probes, want 6", len(probes))
+        }
+
+        // The remaining probes of the intermediate hop keep the wait
+        // for a router, while the silent hop may still be the
+        // destination
+        tests := []struct {
+                ttl, index int
+                hop        net.IP
+                extended   bool
+        }{
+                {1, 0, loopbackRouter, true},
+                {1, 1, net.IPv4zero, false},
+                {1, 2, net.IPv4zero, false},
+                {2, 0, net.IPv4zero, true},
+                {2, 1, net.IPv4zero, true},
+                {2, 2, net.IPv4zero, true},
+        }
+        for i, tc := range tests {
+                p := probes[i]
+                if p.TTL != tc.ttl || !p.Hop.Equal(tc.hop) || p.Reached {
+                        t.Errorf("got probe %d with TTL %d from %v, reached %v, want TTL %d from %v", i, p.TTL, p.Hop, p.Reached, tc.ttl, tc.hop)
+                }
+                timeout, ok := timeouts[[2]int{tc.ttl, tc.index}]
+                if !ok {
+                        t.Errorf("probe %d with TTL %d did not wait", tc.index, tc.ttl)
+                        continue
+                }
+                if extended := timeout > wait; extended != tc.extended {
+                        t.Errorf("probe %d with TTL %d waited up to %v, want extended %v", tc.index, tc.ttl, timeout, tc.extended)
+                }
+        }
+}
+
+func TestEstimateBottleneckLoss(t *testing.T) {
+        // A listener on the destination port swallows the probes, which
+        // must not abort the estimate, whatever the options
+        conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        tracer := New(&Options{
+                DestinationPort:      uint16(conn.LocalAddr().(*net.UDPAddr).Port),
+                MaxHops:              1,
+                NumProbes:            1,
+                ProbeMaxWaitDuration: 20 * time.Millisecond,
+                FailFast:             true,
+                FailFastOnFirstHop:   true,
+                SuppressStars:        true,
+        })
+        _, err = tracer.EstimateBottleneck(context.Background(), net.IPv4(127, 0, 0, 1))
+        if !errors.Is(err, ErrNotEnoughSamples) {
+                t.Errorf("got error %v, want %v", err, ErrNotEnoughSamples)
+        }
+}
+
+func TestSocketOptions(t *testing.T) {
+        tests := []struct {
+                name  string
+                opts  Options
+                level int
+                opt   int
+                want  int
+        }{
+                {"default priority", Options{}, syscall.SOL_SOCKET, syscall.SO_PRIORITY, 0},
+                {"priority", Options{SocketPriority: 5}, syscall.SOL_SOCKET, syscall.SO_PRIORITY, 5},
+                {"without free bind", Options{}, syscall.SOL_IP, syscall.IP_FREEBIND, 0},
+                {"free bind", Options{FreeBind: true}, syscall.SOL_IP, syscall.IP_FREEBIND, 1},
+                {"free bind to a foreign address", Options{FreeBind: true, SourceAddr: net.IPv4(192, 0, 2, 10)}, syscall.SOL_IP, syscall.IP_FREEBIND, 1},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        opts := tc.opts
+                        opts.ProbeMaxWaitDuration = 100 * time.Millisecond
+                        fd, epollFd, err := New(&opts).openSocket(1, 0)
+                        if err != nil {
+                                t.Fatalf("openSocket: %v", err)
+                        }
+                        defer syscall.Close(epollFd)
+                        defer syscall.Close(fd)
+
+                        got, err := syscall.GetsockoptInt(fd, tc.level, tc.opt)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if got != tc.want {
+                                t.Errorf("got %d, want %d", got, tc.want)
+                        }
+                })
+        }
+}
+
+func TestRandomizeTTLOrderResult(t *testing.T) {
+        // A listener on the destination port swallows the probes, so
+        // that the destination only answers via the routed path, which
+        // reaches it with TTL 3
+        conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+        dest := net.IPv4(127, 0, 0, 1)
+        path := []net.IP{loopbackRouter, net.IPv4(127, 0, 0, 3), dest}
+        var mu sync.Mutex
+        order := make([]int, 0)
+        routeProbes(t, port, func(ttl int) net.IP {
+                mu.Lock()
+                defer mu.Unlock()
+                if len(order) == 0 || order[len(order)-1] != ttl {
+                        order = append(order, ttl)
+                }
+                if ttl > len(path) {
+                        return dest
+                }
+                return path[ttl-1]
+        })
+
+        tracer := New(&Options{
+                DestinationPort:      port,
+                MaxHops:              6,
+                NumProbes:            2,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                RandomizeTTLOrder:    true,
+                RandSeed:             1,
+        })
+        result, err := tracer.TraceAll(context.Background(), dest)
+        if err != nil {
+                t.Fatalf("TraceAll: %v", err)
+        }
+
+        mu.Lock()
+        defer mu.Unlock()
+        if len(order) != 6 || sort.IntsAreSorted(order) {
+                t.Errorf("probed the TTLs in order %v, want all 6 shuffled", order)
+        }
+        if len(result.Hops) != len(path) {
+                t.Fatalf("got %d hops, want %d up to the destination", len(result.Hops), len(path))
+        }
+        for i, hop := range result.Hops {
+                if hop.TTL != i+1 || !hop.Addr.Equal(path[i]) || hop.Stats.Received != 2 {
+                        t.Errorf("got hop %d with TTL %d from %v with %d responses, want TTL %d from %v with 2", i, hop.TTL, hop.Addr, hop.Stats.Received, i+1, path[i])
+                }
+        }
+        if !result.Reached || result.DestinationRTT == nil || result.DestinationRTT.Sent != 2 {
+                t.Errorf("got reached %v with %+v, want the destination reached with TTL 3", result.Reached, result.DestinationRTT)
+        }
+}
+
+func TestEmitFirstResponseOrder(t *testing.T) {
+        // A listener on the destination port swallows the probes, while
+        // the router of the first hop only answers its second probe,
+        // the second hop does not answer at all, and the third reaches
+        // the destination
+        conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+        port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+        dest := net.IPv4(127, 0, 0, 1)
+        var mu sync.Mutex
+        sent := make(map[int]int)
+        routeProbes(t, port, func(ttl int) net.IP {
+                mu.Lock()
+                defer mu.Unlock()
+                sent[ttl]++
+                switch {
+                case ttl == 1 && sent[ttl] == 2:
+                        return loopbackRouter
+                case ttl == 3:
+                        return dest
+                }
+                return nil
+        })
+
+        tracer := New(&Options{
+                DestinationPort:      port,
+                MaxHops:              3,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: 50 * time.Millisecond,
+                EmitFirstResponse:    true,
+        })
+        delivered := make(map[int][]Probe)
+        for probe := range tracer.Trace(context.Background(), dest) {
+                if probe.Error != nil {
+                        t.Fatal(probe.Error)
+                }
+                delivered[probe.TTL] = append(delivered[probe.TTL], probe)
+        }
+
+        // The first responding probe of a hop is delivered first, or
+        // its first probe if none responded, followed by the rest as
+        // refinements
+        tests := []struct {
+                ttl       int
+                responded []bool
+        }{
+                {1, []bool{true, false, false}},
+                {2, []bool{false, false, false}},
+                {3, []bool{true, true, true}},
+        }
+        for _, tc := range tests {
+                probes := delivered[tc.ttl]
+                if len(probes) != len(tc.responded) {
+                        t.Errorf("got %d probes with TTL %d, want %d", len(probes), tc.ttl, len(tc.responded))
+                        continue
+                }
+                for i, p := range probes {
+                        if p.Responded() != tc.responded[i] {
+                                t.Errorf("probe %d with TTL %d responded %v, want %v", i, tc.ttl, p.Responded(), tc.responded[i])
+                        }
+                        if p.Refinement != (i > 0) {
+                                t.Errorf("probe %d with TTL %d has Refinement %v, want %v", i, tc.ttl, p.Refinement, i > 0)
+                        }
+                }
+        }
+}
@@ -0,0 +1,565 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "errors"
+        "math/rand"
+        "net"
+        "os"
+        "sync"
+        "syscall"
+        "testing"
+        "time"
+)
+
+func TestDeliverStars(t *testing.T) {
+        hop := net.IPv4(192, 0, 2, 1)
+        probes := []Probe{
+                {TTL: 1, Hop: hop},
+                {TTL: 1, Hop: net.IPv4zero},
+                {TTL: 1},
+                {Error: errors.New("trace failed")},
+        }
+
+        tests := []struct {
+                name     string
+                suppress bool
+                want     int
+        }{
+                {"default", false, 4},
+                {"suppressed", true, 2},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        tracer := New(&Options{SuppressStars: tc.suppress})
+                        ch := make(chan Probe, len(probes))
+                        for _, p := range probes {
+                                tracer.deliver(ch, p)
+                        }
+                        close(ch)
+
+                        got := 0
+                        for p := range ch {
+                                if tc.suppress && p.Error == nil && !p.Responded() {
+                                        t.Errorf("star probe %+v was delivered", p)
+                                }
+                                got++
+                        }
+                        if got != tc.want {
+                                t.Errorf("delivered %d probes, want %d", got, tc.want)
+                        }
+                })
+        }
+}
+
+func TestAcceptReply(t *testing.T) {
+        const (
+                wait     = 100 * time.Millisecond
+                destWait = 500 * time.Millisecond
+        )
+
+        tests := []struct {
+                name     string
+                elapsed  time.Duration
+                destWait time.Duration
+                reached  bool
+                want     bool
+        }{
+                {"hop within wait", 50 * time.Millisecond, destWait, false, true},
+                {"destination within wait", 50 * time.Millisecond, destWait, true, true},
+                {"hop after wait", 200 * time.Millisecond, destWait, false, false},
+                {"destination after wait", 200 * time.Millisecond, destWait, true, true},
+                {"destination after destWait", 600 * time.Millisecond, destWait, true, false},
+                {"destination after wait without destWait", 200 * time.Millisecond, 0, true, false},
+                {"destination after wait with shorter destWait", 200 * time.Millisecond, 50 * time.Millisecond, true, false},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        if got := acceptReply(tc.elapsed, wait, tc.destWait, tc.reached); got != tc.want {
+                                t.Errorf("acceptReply(%v) = %v, want %v", tc.elapsed, got, tc.want)
+                        }
+                })
+        }
+}
+
+func TestReplyWait(t *testing.T) {
+        tests := []struct {
+                wait     time.Duration
+                destWait time.Duration
+                want     time.Duration
+        }{
+                {time.Second, 0, time.Second},
+                {time.Second, 3 * time.Second, 3 * time.Second},
+                {time.Second, 500 * time.Millisecond, time.Second},
+        }
+
+        for _, tc := range tests {
+                if got := replyWait(tc.wait, tc.destWait); got != tc.want {
+                        t.Errorf("replyWait(%v, %v) = %v, want %v", tc.wait, tc.destWait, got, tc.want)
+                }
+        }
+}
+
+func TestHopProbes(t *testing.T) {
+        tests := []struct {
+                name string
+                opts Options
+                // Responses of the probes in the order they are sent
+                responses []bool
+                want      int
+        }{
+                {"fixed clean", Options{NumProbes: 3}, []bool{true, true, true, true, true, true}, 3},
+                {"fixed lossy", Options{NumProbes: 3}, []bool{true, false, true, true, true, true}, 3},
+                {"clean", Options{NumProbes: 3, AdaptiveProbes: true}, []bool{true, true, true, true, true, true}, 2},
+                {"clean with minimum", Options{NumProbes: 4, AdaptiveProbes: true, MinAdaptiveProbes: 1}, []bool{true, true, true, true}, 1},
+                {"early loss", Options{NumProbes: 3, AdaptiveProbes: true}, []bool{false, true, true, true, true, true}, 6},
+                {"late loss", Options{NumProbes: 3, AdaptiveProbes: true, MinAdaptiveProbes: 3}, []bool{true, true, false, true, true, true}, 6},
+                {"capped", Options{NumProbes: 3, AdaptiveProbes: true, MaxAdaptiveProbes: 4}, []bool{true, false, true, true, true, true}, 4},
+                {"dark", Options{NumProbes: 3, AdaptiveProbes: true}, []bool{false, false, false, false, false, false}, 3},
+                {"cap below regular", Options{NumProbes: 3, AdaptiveProbes: true, MaxAdaptiveProbes: 2}, []bool{false, true, false, true}, 3},
+                {"no probes", Options{AdaptiveProbes: true}, []bool{true}, 0},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        tracer := New(&tc.opts)
+                        sent, responses := 0, 0
+                        for ; sent < tracer.hopProbes(sent, responses); sent++ {
+                                if sent == len(tc.responses) {
+                                        t.Fatalf("more than %d probes", len(tc.responses))
+                                }
+                                if tc.responses[sent] {
+                                        responses++
+                                }
+                        }
+                        if sent != tc.want {
+                                t.Errorf("sent %d probes, want %d", sent, tc.want)
+                        }
+                })
+        }
+}
+
+// A ReplyParser, which attaches its name to each reply
+type namedParser string
+
+func (p namedParser) Parse(reply, oob []byte) any {
+        return string(p)
+}
+
+func TestOptionsCopy(t *testing.T) {
+        tracer := New(&Options{
+                ProbeSendOffsets: []time.Duration{time.Millisecond},
+                ReplyParsers:     []ReplyParser{namedParser("first")},
+                SourceAddr:       net.IPv4(192, 0, 2, 10),
+        })
+
+        opts := tracer.Options()
+        opts.ProbeSendOffsets[0] = time.Second
+        opts.ReplyParsers[0] = namedParser("second")
+        opts.SourceAddr[len(opts.SourceAddr)-1] = 20
+
+        got := tracer.Options()
+        if got.ProbeSendOffsets[0] != time.Millisecond {
+                t.Errorf("ProbeSendOffsets changed to %v", got.ProbeSendOffsets)
+        }
+        if got.ReplyParsers[0] != namedParser("first") {
+                t.Errorf("ReplyParsers changed to %v", got.ReplyParsers)
+        }
+        if !got.SourceAddr.Equal(net.IPv4(192, 0, 2, 10)) {
+                t.Errorf("SourceAddr changed to %v", got.SourceAddr)
+        }
+
+        // Unset options stay unset
+        if opts := New(&Options{}).Options(); opts.SourceAddr != nil || opts.ReplyParsers != nil {
+                t.Errorf("got SourceAddr %v and ReplyParsers %v, want nil", opts.SourceAddr, opts.ReplyParsers)
+        }
+}
+
+func TestEmitFirstResponseWithoutProbes(t *testing.T) {
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              3,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                EmitFirstResponse:    true,
+        })
+
+        done := make(chan int)
+        go func() {
+                probes := 0
+                for range tracer.Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                        probes++
+                }
+                done <- probes
+        }()
+
+        select {
+        case probes := <-done:
+                if probes != 0 {
+                        t.Errorf("got %d probes, want none", probes)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("trace without probes did not complete")
+        }
+}
+
+func TestProbePort(t *testing.T) {
+        tests := []struct {
+                port int
+                i    int
+                want int
+        }{
+                {33434, 0, 33434},
+                {33434, 2, 33436},
+                {65535, 0, 65535},
+                {65535, 1, 1},
+                {65534, 3, 2},
+                {1, 65535, 1},
+        }
+
+        for _, tc := range tests {
+                if got := probePort(tc.port, tc.i); got != tc.want {
+                        t.Errorf("probePort(%d, %d) = %d, want %d", tc.port, tc.i, got, tc.want)
+                }
+        }
+}
+
+func TestRandSeedDeterminism(t *testing.T) {
+        // Returns the TTLs and payloads of the probes of a trace to the
+        // loopback address, in the order they were sent
+        run := func(opts Options) ([]int, [][]byte) {
+                opts.DestinationPort = 33434
+                opts.MaxHops = 8
+                opts.NumProbes = 2
+                opts.PacketLength = 16
+                opts.ProbeMaxWaitDuration = 100 * time.Millisecond
+                opts.RandomizePayload = true
+                opts.RandomizeTTLOrder = true
+
+                var ttls []int
+                var payloads [][]byte
+                for probe := range New(&opts).Trace(context.Background(), net.IPv4(127, 0, 0, 1)) {
+                        if probe.Error != nil {
+                                t.Fatal(probe.Error)
+                        }
+                        ttls = append(ttls, probe.TTL)
+                        payloads = append(payloads, probe.Payload)
+                }
+                return ttls, payloads
+        }
+        equal := func(a, b [][]byte) bool {
+                if len(a) != len(b) {
+                        return false
+                }
+                for i := range a {
+                        if !bytes.Equal(a[i], b[i]) {
+                                return false
+                        }
+                }
+                return true
+        }
+
+        ttls, payloads := run(Options{RandSeed: 42})
+        if len(ttls) != 16 {
+                t.Fatalf("got %d probes, want 16", len(ttls))
+        }
+
+        tests := []struct {
+                name string
+                opts Options
+                same bool
+        }{
+                {"same seed", Options{RandSeed: 42}, true},
+                {"same source", Options{RandSource: rand.NewSource(42)}, true},
+                {"other seed", Options{RandSeed: 43}, false},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        gotTTLs, gotPayloads := run(tc.opts)
+                        if same := equalInts(gotTTLs, ttls) && equal(gotPayloads, payloads); same != tc.same {
+                                t.Errorf("got TTLs %v, want the same as %v: %v", gotTTLs, ttls, tc.same)
+                        }
+                })
+        }
+}
+
+func TestParseTarget(t *testing.T) {
+        tests := []struct {
+                target string
+                host   string
+                port   uint16
+                err    bool
+        }{
+                {"example.com", "example.com", 0, false},
+                {"192.0.2.1", "192.0.2.1", 0, false},
+                {"example.com:53", "example.com", 53, false},
+                {"192.0.2.1:33434", "192.0.2.1", 33434, false},
+                {"[2001:db8::1]:443", "2001:db8::1", 443, false},
+                {"2001:db8::1", "2001:db8::1", 0, false},
+                {"example.com:domain", "example.com", 53, false},
+                {"https://example.com/path", "example.com", 443, false},
+                {"http://example.com:8080", "example.com", 8080, false},
+                {"http://[2001:db8::1]/", "2001:db8::1", 80, false},
+                {"", "", 0, true},
+                {":53", "", 0, true},
+                {"example.com:70000", "", 0, true},
+                {"example.com:no-such-service", "", 0, true},
+                {"no-such-scheme://example.com", "", 0, true},
+                {"http://:80", "", 0, true},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.target, func(t *testing.T) {
+                        host, port, err := parseTarget(tc.target)
+                        if tc.err {
+                                if err == nil {
+                                        t.Errorf("got %q and %d, want an error", host, port)
+                                }
+                                return
+                        }
+                        if err != nil {
+                                t.Fatalf("parseTarget: %v", err)
+                        }
+                        if host != tc.host || port != tc.port {
+                                t.Errorf("got %q and %d, want %q and %d", host, port, tc.host, tc.port)
+                        }
+                })
+        }
+}
+
+func TestReportWait(t *testing.T) {
+        tests := []struct {
+                name string
+                n    int
+                err  error
+                want WaitOutcome
+        }{
+                {"ready", 1, nil, WaitReady},
+                {"timeout", 0, nil, WaitTimeout},
+                {"failed", -1, syscall.EINTR, WaitFailed},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        var got []TimingEvent
+                        tracer := New(&Options{TimingHook: func(e TimingEvent) {
+                                got = append(got, e)
+                        }})
+                        sent := time.Now()
+                        tracer.reportWait(3, 1, sent, time.Second, sent, tc.n, tc.err)
+
+                        if len(got) != 1 {
+                                t.Fatalf("got %d events, want 1", len(got))
+                        }
+                        e := got[0]
+                        if e.TTL != 3 || e.ProbeIndex != 1 || !e.Sent.Equal(sent) || e.Timeout != time.Second {
+                                t.Errorf("got event %+v for the wrong probe", e)
+                        }
+                        if e.Outcome != tc.want {
+                                t.Errorf("got outcome %v, want %v", e.Outcome, tc.want)
+                        }
+                        if e.Blocked < 0 || e.Blocked > time.Second {
+                                t.Errorf("got blocked for %v, want within the timeout", e.Blocked)
+                        }
+                })
+        }
+}
+
+func TestTraceWithTag(t *testing.T) {
+        type request struct{ id int }
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              3,
+                NumProbes:            3,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        })
+
+        tags := []any{"first", &request{id: 2}, nil}
+        var wg sync.WaitGroup
+        for _, tag := range tags {
+                wg.Add(1)
+                go func(tag any) {
+                        defer wg.Done()
+                        probes := 0
+                        for probe := range tracer.TraceWithTag(context.Background(), net.IPv4(127, 0, 0, 1), tag) {
+                                probes++
+                                if probe.Tag != tag {
+                                        t.Errorf("got tag %v, want %v", probe.Tag, tag)
+                                }
+                        }
+                        if probes == 0 {
+                                t.Errorf("got no probes for tag %v", tag)
+                        }
+                }(tag)
+        }
+        wg.Wait()
+
+        // The error of a failed trace is tagged as well
+        failing := New(&Options{DestinationPort: 33434, MaxHops: 1, NumProbes: 1, SourceAddr: net.IPv4(192, 0, 2, 10)})
+        for probe := range failing.TraceWithTag(context.Background(), net.IPv4(127, 0, 0, 1), "failed") {
+                if probe.Error == nil || probe.Tag != "failed" {
+                        t.Errorf("got probe %+v, want a tagged error", probe)
+                }
+        }
+
+        // Tags are not part of the JSON encoding of a probe
+        b, err := json.Marshal(Probe{Tag: "secret"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        if bytes.Contains(b, []byte("secret")) {
+                t.Errorf("got tag in %s", b)
+        }
+}
+
+func TestTraceCancelRace(t *testing.T) {
+        tests := []struct {
+                name string
+                opts Options
+        }{
+                {"sequential hops", Options{}},
+                {"background hops", Options{EmitFirstResponse: true}},
+                {"coarse timing", Options{CoarseTiming: true}},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        opts := tc.opts
+                        opts.DestinationPort = 33434
+                        opts.MaxHops = 3
+                        opts.NumProbes = 2
+                        opts.ProbeMaxWaitDuration = 100 * time.Millisecond
+                        tracer := New(&opts)
+
+                        // Cancel at varying points, from before the
+                        // first probe until after the trace completed
+                        for i := 0; i < 50; i++ {
+                                ctx, cancel := context.WithCancel(context.Background())
+                                ch := tracer.Trace(ctx, net.IPv4(127, 0, 0, 1))
+                                go func(delay time.Duration) {
+                                        time.Sleep(delay)
+                                        cancel()
+                                }(time.Duration(i) * 5 * time.Microsecond)
+
+                                done := make(chan struct{})
+                                go func() {
+                                        defer close(done)
+                                        for range ch {
+                                        }
+                                }()
+                                select {
+                                case <-done:
+                                case <-time.After(5 * time.Second):
+                                        t.Fatalf("trace %d was not closed", i)
+                                }
+                                cancel()
+                        }
+                })
+        }
+}
+
+func TestOnHopDiscovered(t *testing.T) {
+        dest := net.IPv4(127, 0, 0, 1)
+        ttls := []int{1, 2, 3}
+
+        tests := []struct {
+                name  string
+                early bool
+        }{
+                {"sequential", false},
+                {"first response", true},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        var mu sync.Mutex
+                        discovered := make(map[int]int)
+                        tracer := New(&Options{
+                                DestinationPort:      33434,
+                                MaxHops:              len(ttls),
+                                NumProbes:            3,
+                                ProbeMaxWaitDuration: 100 * time.Millisecond,
+                                EmitFirstResponse:    tc.early,
+                                OnHopDiscovered: func(hop HopDiscovered) {
+                                        mu.Lock()
+                                        defer mu.Unlock()
+                                        if !hop.IP.Equal(dest) {
+                                                t.Errorf("got hop %v discovered with TTL %d, want %v", hop.IP, hop.TTL, dest)
+                                        }
+                                        discovered[hop.TTL]++
+                                },
+                        })
+
+                        // Each TTL reaches the destination on the
+                        // loopback interface, and is discovered before
+                        // its first probe is delivered
+                        delivered := make(map[int]int)
+                        for probe := range tracer.TraceTTLs(context.Background(), dest, ttls) {
+                                if probe.Error != nil {
+                                        t.Fatal(probe.Error)
+                                }
+                                mu.Lock()
+                                if discovered[probe.TTL] != 1 {
+                                        t.Errorf("probe with TTL %d delivered with the hop discovered %d times", probe.TTL, discovered[probe.TTL])
+                                }
+                                mu.Unlock()
+                                delivered[probe.TTL]++
+                        }
+
+                        for _, ttl := range ttls {
+                                if discovered[ttl] != 1 || delivered[ttl] != 3 {
+                                        t.Errorf("TTL %d discovered %d times with %d probes, want once with 3", ttl, discovered[ttl], delivered[ttl])
+                                }
+                        }
+                })
+        }
+}
+
+func TestTraceAllMethod(t *testing.T) {
+        tracer := New(&Options{
+                DestinationPort:      33434,
+                MaxHops:              1,
+                NumProbes:            1,
+                ProbeMaxWaitDuration: 100 * time.Millisecond,
+        })
+        result, err := tracer.TraceAll(context.Background(), net.IPv4(127, 0, 0, 1))
+        if err != nil {
+                t.Fatalf("TraceAll: %v", err)
+        }
+
+        if result.Method != traceMethod {
+                t.Errorf("got method %v, want %v", result.Method, traceMethod)
+        }
+        if privileged := os.Geteuid() == 0; result.Privileged != privileged {
+                t.Errorf("got privileged %v with effective user ID %d", result.Privileged, os.Geteuid())
+        }
+}
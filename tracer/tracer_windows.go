@@ -0,0 +1,256 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "errors"
+        "fmt"
+        "net"
+        "runtime"
+        "syscall"
+        "time"
+        "unsafe"
+
+        "golang.org/x/sys/windows"
+)
+
+// On Windows the probes are sent as ICMP echo requests via the IP
+// Helper API, the same way as tracert does, since there is no error
+// queue to read the ICMP errors for UDP probes from. The hops are
+// recognized by their time exceeded replies, and the destination by
+// its echo reply. Unlike on Linux, the following options have no
+// effect: DestinationPort, DistinctPorts, ClockSource (the probes
+// always use ClockMonotonic), SendBufferSize, SocketPriority, Mark,
+// FreeBind, SourcePortMin and SourcePortMax, ReplyParsers and
+// TimingHook. The managed socket of Open is not available either.
+
+// Traces use ICMP echo requests
+const traceMethod = MethodICMPEcho
+
+var (
+        iphlpapi            = windows.NewLazySystemDLL("iphlpapi.dll")
+        procIcmpCreateFile  = iphlpapi.NewProc("IcmpCreateFile")
+        procIcmpCloseHandle = iphlpapi.NewProc("IcmpCloseHandle")
+        procIcmpSendEcho2Ex = iphlpapi.NewProc("IcmpSendEcho2Ex")
+
+        kernel32                  = windows.NewLazySystemDLL("kernel32.dll")
+        procSetThreadAffinityMask = kernel32.NewProc("SetThreadAffinityMask")
+)
+
+// Status codes of an ICMP echo reply, see ipexport.h
+const (
+        ipSuccess              = 0
+        ipDestNetUnreachable   = 11002
+        ipDestHostUnreachable  = 11003
+        ipDestProtUnreachable  = 11004
+        ipDestPortUnreachable  = 11005
+        ipReqTimedOut          = 11010
+        ipTTLExpiredTransit    = 11013
+        ipTTLExpiredReassembly = 11014
+)
+
+// IP_OPTION_INFORMATION, see ipexport.h
+type ipOptionInformation struct {
+        ttl         uint8
+        tos         uint8
+        flags       uint8
+        optionsSize uint8
+        optionsData *byte
+}
+
+// ICMP_ECHO_REPLY, see ipexport.h
+type icmpEchoReply struct {
+        address       [4]byte
+        status        uint32
+        roundTripTime uint32
+        dataSize      uint16
+        reserved      uint16
+        data          uintptr
+        options       ipOptionInformation
+}
+
+// IcmpSendEcho2Ex blocks until the reply arrives, so there is nothing
+// to wait on
+type poller struct{}
+
+// Creates a new poller.
+func (t *Tracer) newPoller(ttl int) (*poller, error) {
+        return &poller{}, nil
+}
+
+// Closes the poller.
+func (p *poller) close() {}
+
+// ICMP handle for sending the probes of a hop
+type probeConn struct {
+        handle uintptr
+}
+
+// Opens an ICMP handle. The source port is ignored, since ICMP has no
+// ports.
+func (t *Tracer) openConn(p *poller, ttl, srcPort int) (*probeConn, error) {
+        handle, _, err := procIcmpCreateFile.Call()
+        if windows.Handle(handle) == windows.InvalidHandle {
+                return nil, t.setupError("IcmpCreateFile", ttl, err)
+        }
+
+        return &probeConn{handle: handle}, nil
+}
+
+// Closes the ICMP handle.
+func (c *probeConn) close() {
+        procIcmpCloseHandle.Call(c.handle)
+}
+
+// Returns zero, since ICMP has no ports.
+func (c *probeConn) localPort() uint16 {
+        return 0
+}
+
+// Sends a single probe to the destination and waits up to the given
+// duration for the reply, or up to destWait for a reply of the
+// destination.
+func (t *Tracer) sendProbe(c *probeConn, to *syscall.SockaddrInet4, ttl, seq int, wait, destWait time.Duration) (Probe, error) {
+        b, err := t.encoder.Encode(ttl, seq)
+        if err != nil {
+                return Probe{}, fmt.Errorf("unable to encode probe with TTL %d: %w", ttl, err)
+        }
+
+        options := ipOptionInformation{ttl: uint8(ttl)}
+        if t.opts.RouterAlert {
+                options.optionsSize = uint8(len(routerAlertOption))
+                options.optionsData = &routerAlertOption[0]
+        }
+
+        var src [4]byte
+        copy(src[:], t.opts.SourceAddr.To4())
+
+        var data unsafe.Pointer
+        if len(b) > 0 {
+                data = unsafe.Pointer(&b[0])
+        }
+
+        // The reply buffer has to hold the reply, the echoed data and
+        // the error information of an ICMP error
+        reply := make([]byte, int(unsafe.Sizeof(icmpEchoReply{}))+len(b)+8+16)
+
+        timeout := replyWait(wait, destWait).Milliseconds()
+        start := t.now()
+        n, _, callErr := procIcmpSendEcho2Ex.Call(
+                c.handle,
+                0,
+                0,
+                0,
+                uintptr(*(*uint32)(unsafe.Pointer(&src[0]))),
+                uintptr(*(*uint32)(unsafe.Pointer(&to.Addr[0]))),
+                uintptr(data),
+                uintptr(len(b)),
+                uintptr(unsafe.Pointer(&options)),
+                uintptr(unsafe.Pointer(&reply[0])),
+                uintptr(len(reply)),
+                uintptr(timeout),
+        )
+        end := t.now()
+
+        probe := Probe{
+                Start:     start,
+                End:       end,
+                Hop:       net.IPv4zero,
+                TTL:       ttl,
+                SentBytes: len(b),
+        }
+        if t.opts.RandomizePayload || t.opts.UniquePayloadPerProbe || t.opts.Encoder != nil {
+                probe.Payload = b
+        }
+
+        echo := (*icmpEchoReply)(unsafe.Pointer(&reply[0]))
+        status := echo.status
+        if n == 0 {
+                var errno syscall.Errno
+                if !errors.As(callErr, &errno) {
+                        return Probe{}, sendError(ttl, callErr)
+                }
+                status = uint32(errno)
+        }
+
+        switch status {
+        case ipSuccess:
+                probe.Reached = true
+        case ipTTLExpiredTransit, ipTTLExpiredReassembly,
+                ipDestHostUnreachable, ipDestProtUnreachable, ipDestPortUnreachable:
+        case ipDestNetUnreachable:
+                if n == 0 {
+                        return Probe{}, sendError(ttl, syscall.Errno(status))
+                }
+        case ipReqTimedOut:
+                return probe, nil
+        default:
+                return Probe{}, sendError(ttl, syscall.Errno(status))
+        }
+
+        // Past wait only the destination may still respond
+        if !acceptReply(end.Sub(start), wait, destWait, probe.Reached) {
+                return probe, nil
+        }
+
+        probe.Hop = net.IPv4(echo.address[0], echo.address[1], echo.address[2], echo.address[3])
+        probe.ReplyBytes = int(echo.dataSize)
+        probe.ReplyTTL = int(echo.options.ttl)
+        if probe.Reached && !probe.Hop.Equal(net.IP(to.Addr[:])) {
+                probe.RepliedFrom = probe.Hop
+        }
+        t.checkRTT(&probe)
+
+        return probe, nil
+}
+
+// Returns the error of a failed send of a probe with the given TTL,
+// which wraps ErrNoRoute if the destination is unreachable from here.
+func sendError(ttl int, err error) error {
+        if errors.Is(err, syscall.Errno(ipDestNetUnreachable)) {
+                return fmt.Errorf("%w: %w", ErrNoRoute, err)
+        }
+
+        return fmt.Errorf("unable to send probe with TTL %d: %w", ttl, err)
+}
+
+// Locks the calling goroutine to its OS thread and pins the thread to
+// the given CPU. The thread is intentionally never unlocked, so that
+// the runtime terminates it once the goroutine exits, instead of
+// reusing a thread with a modified affinity.
+func pinCPU(cpu int) error {
+        runtime.LockOSThread()
+
+        thread, err := windows.GetCurrentThread()
+        if err != nil {
+                return fmt.Errorf("unable to pin to CPU %d: %w", cpu, err)
+        }
+        if r, _, err := procSetThreadAffinityMask.Call(uintptr(thread), uintptr(1)<<cpu); r == 0 {
+                return fmt.Errorf("unable to pin to CPU %d: %w", cpu, err)
+        }
+
+        return nil
+}
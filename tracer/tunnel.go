@@ -0,0 +1,93 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+// Minimum number of hops, by which the return path has to grow in
+// excess of the forward path, for a segment to be considered tunneled
+const minHiddenHops = 2
+
+// Common initial TTLs of the IP stacks of routers
+var initialTTLs = []int{32, 64, 128, 255}
+
+// TTLRange represents a range of TTLs, including both ends.
+type TTLRange struct {
+        From int `json:"from"`
+        To   int `json:"to"`
+}
+
+// PossibleTunnels returns the segments of the path, which possibly
+// hide routers in a tunnel, e.g. an MPLS tunnel without TTL
+// propagation. A segment between two consecutive responding hops is
+// flagged, when the length of the return path as derived from their
+// reply TTLs grows by at least two hops more than the TTL did. This is
+// a heuristic, which is also triggered by asymmetric return paths,
+// and only considers hops which report a reply TTL and use the same
+// initial TTL.
+func (r *Result) PossibleTunnels() []TTLRange {
+        tunnels := make([]TTLRange, 0)
+
+        var prev *Hop
+        for i := range r.Hops {
+                hop := &r.Hops[i]
+                if hop.ReplyTTL == 0 {
+                        continue
+                }
+                if prev != nil && initialTTL(prev.ReplyTTL) == initialTTL(hop.ReplyTTL) {
+                        forward := hop.TTL - prev.TTL
+                        reverse := prev.ReplyTTL - hop.ReplyTTL
+                        if reverse-forward >= minHiddenHops {
+                                tunnels = append(tunnels, TTLRange{From: prev.TTL, To: hop.TTL})
+                        }
+                }
+                prev = hop
+        }
+
+        return tunnels
+}
+
+// Returns the most likely initial TTL of a packet, which arrived with
+// the given TTL
+func initialTTL(ttl int) int {
+        for _, initial := range initialTTLs {
+                if ttl <= initial {
+                        return initial
+                }
+        }
+
+        return initialTTLs[len(initialTTLs)-1]
+}
+
+// Returns the estimated number of hops of the return path of a reply,
+// which arrived with the given TTL, or zero if the TTL is unknown. The
+// responding router itself counts as a hop, as it does for the TTL of
+// the probe.
+func reverseHops(ttl int) int {
+        if ttl <= 0 {
+                return 0
+        }
+
+        return initialTTL(ttl) - ttl + 1
+}
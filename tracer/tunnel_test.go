@@ -0,0 +1,89 @@
+// Copyright (c) 2023 Marin Atanasov Nikolov <dnaeon@gmail.com>
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer
+//     in this position and unchanged.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR(S) ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHOR(S) BE LIABLE FOR ANY DIRECT, INDIRECT,
+// INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT
+// NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package tracer
+
+import (
+        "reflect"
+        "testing"
+)
+
+func TestPossibleTunnels(t *testing.T) {
+        // Returns a result with a hop per TTL starting at 1, which
+        // replied with the given TTL, or did not report it if zero
+        result := func(replyTTLs ...int) *Result {
+                r := &Result{}
+                for i, ttl := range replyTTLs {
+                        r.Hops = append(r.Hops, Hop{TTL: i + 1, ReplyTTL: ttl})
+                }
+                return r
+        }
+
+        tests := []struct {
+                name   string
+                result *Result
+                want   []TTLRange
+        }{
+                {"symmetric", result(64, 63, 62, 61), []TTLRange{}},
+                {"one extra return hop", result(64, 63, 61, 60), []TTLRange{}},
+                {"hidden hops", result(64, 63, 59, 58), []TTLRange{{From: 2, To: 3}}},
+                {"hidden hops behind a dark hop", result(64, 63, 0, 58), []TTLRange{{From: 2, To: 4}}},
+                {"dark hop without hidden hops", result(64, 63, 0, 61), []TTLRange{}},
+                {"different initial TTLs", result(64, 63, 250, 240), []TTLRange{{From: 3, To: 4}}},
+                {"initial TTL change", result(64, 63, 250, 249), []TTLRange{}},
+                {"two tunnels", result(255, 250, 249, 245), []TTLRange{{From: 1, To: 2}, {From: 3, To: 4}}},
+                {"no reply TTLs", result(0, 0, 0), []TTLRange{}},
+        }
+
+        for _, tc := range tests {
+                t.Run(tc.name, func(t *testing.T) {
+                        if got := tc.result.PossibleTunnels(); !reflect.DeepEqual(got, tc.want) {
+                                t.Errorf("got %v, want %v", got, tc.want)
+                        }
+                })
+        }
+}
+
+func TestReverseHops(t *testing.T) {
+        tests := []struct {
+                ttl  int
+                want int
+        }{
+                {0, 0},
+                {-1, 0},
+                {64, 1},
+                {61, 4},
+                {128, 1},
+                {120, 9},
+                {250, 6},
+                {32, 1},
+        }
+
+        for _, tc := range tests {
+                if got := reverseHops(tc.ttl); got != tc.want {
+                        t.Errorf("reverseHops(%d) = %d, want %d", tc.ttl, got, tc.want)
+                }
+        }
+}